@@ -0,0 +1,134 @@
+package wysci
+
+import (
+	"database/sql"
+	"math/big"
+	"strings"
+)
+
+// Splits a comma separated list of column names
+func splitColumns(list string) []string {
+	columns := []string{}
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// BreakColumns returns the columns listed in the query's break setting.
+func (q QueryConfig) BreakColumns() []string {
+	return splitColumns(q.Break)
+}
+
+// Tracks the values of the break columns so a formatter can tell when
+// consecutive rows start a new group.
+type breakTracker struct {
+	indexes []int
+	current []sql.NullString
+	started bool
+}
+
+func newBreakTracker(q Query, columns []string) (*breakTracker, error) {
+	bt := &breakTracker{
+		indexes: make([]int, len(columns)),
+		current: make([]sql.NullString, len(columns)),
+	}
+
+	for i, c := range columns {
+		idx, err := q.IndexOf(c)
+		if err != nil {
+			return nil, err
+		}
+		bt.indexes[i] = idx
+	}
+
+	return bt, nil
+}
+
+// Returns true if the column is one of the break columns
+func (bt *breakTracker) isBreak(col int) bool {
+	for _, idx := range bt.indexes {
+		if idx == col {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the row and returns true if it starts a new group.  The first
+// row always starts a new group.
+func (bt *breakTracker) next(values []sql.NullString) bool {
+	changed := !bt.started
+	for i, idx := range bt.indexes {
+		if values[idx] != bt.current[i] {
+			changed = true
+		}
+		bt.current[i] = values[idx]
+	}
+	bt.started = true
+
+	return changed
+}
+
+// Accumulates exact sums of the numeric columns in a group
+type subtotals struct {
+	numeric []bool
+	sums    []*big.Rat
+	scales  []int
+	rows    int
+}
+
+func newSubtotals(types []DBType, columns int) *subtotals {
+	s := &subtotals{
+		numeric: make([]bool, columns),
+		sums:    make([]*big.Rat, columns),
+		scales:  make([]int, columns),
+	}
+
+	for i := 0; i < columns && i < len(types); i++ {
+		s.numeric[i] = types[i] == DBNumber
+	}
+
+	s.reset()
+	return s
+}
+
+func (s *subtotals) reset() {
+	for i := range s.sums {
+		s.sums[i] = new(big.Rat)
+		s.scales[i] = 0
+	}
+	s.rows = 0
+}
+
+// Adds the numeric values of the row.  Values that are not plain numbers,
+// such as formatted currency, are skipped.
+func (s *subtotals) add(values []sql.NullString) {
+	for i, v := range values {
+		if i >= len(s.numeric) || !s.numeric[i] || !v.Valid {
+			continue
+		}
+
+		value, ok := new(big.Rat).SetString(strings.TrimSpace(v.String))
+		if !ok {
+			continue
+		}
+		s.sums[i].Add(s.sums[i], value)
+
+		mantissa := strings.SplitN(strings.ToLower(v.String), "e", 2)[0]
+		if dot := strings.Index(mantissa, "."); dot >= 0 {
+			if scale := len(strings.TrimSpace(mantissa[dot+1:])); scale > s.scales[i] {
+				s.scales[i] = scale
+			}
+		}
+	}
+	s.rows++
+}
+
+// Returns the sum of the column at the largest scale of its values
+func (s *subtotals) total(col int) string {
+	return s.sums[col].FloatString(s.scales[col])
+}
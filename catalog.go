@@ -0,0 +1,380 @@
+package wysci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// CatalogParameter describes an endpoint parameter in the catalog
+type CatalogParameter struct {
+	Name     string      `json:"name"`
+	In       string      `json:"in"`
+	Type     string      `json:"type"`
+	Items    string      `json:"items,omitempty"`
+	Required bool        `json:"required"`
+	Default  interface{} `json:"default,omitempty"`
+	Values   []string    `json:"values,omitempty"`
+	Layout   string      `json:"layout,omitempty"`
+	Ordinal  int         `json:"ordinal"`
+}
+
+// CatalogColumn describes a result column in the catalog
+type CatalogColumn struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	DatabaseType string `json:"databaseType"`
+}
+
+// CatalogEndpoint describes a configured endpoint in the catalog
+type CatalogEndpoint struct {
+	Name       string             `json:"name"`
+	Path       string             `json:"path"`
+	Query      string             `json:"query"`
+	Database   string             `json:"database"`
+	Mutating   bool               `json:"mutating,omitempty"`
+	Parameters []CatalogParameter `json:"parameters"`
+	Formats    []string           `json:"formats"`
+	Columns    []CatalogColumn    `json:"columns,omitempty"`
+	Roles      []string           `json:"roles,omitempty"`
+}
+
+// Catalog describes the endpoints a server exposes
+type Catalog struct {
+	Endpoints []CatalogEndpoint `json:"endpoints"`
+}
+
+// Matches the :name and *name segments of an httprouter path
+var routeParameter = regexp.MustCompile(`[:*]([^/]+)`)
+
+// Returns the names of the parameters in an httprouter path
+func routeParameters(route string) map[string]bool {
+	names := map[string]bool{}
+	for _, match := range routeParameter.FindAllStringSubmatch(route, -1) {
+		names[match[1]] = true
+	}
+	return names
+}
+
+// Discovers the result columns of a query by executing it for no rows
+// with every parameter set to NULL
+func discoverColumns(ctx context.Context, db Database, query QueryConfig, parameterCount int) ([]CatalogColumn, error) {
+	statement := strings.TrimRight(strings.TrimSpace(query.SQL), ";")
+	statement = fmt.Sprintf("select * from (%s) wysci_columns limit 0", statement)
+
+	// Discovering the columns never changes the database, even for a
+	// mutating query
+	s, err := startSession(ctx, db, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.end(false)
+
+	statement, args := db.Rebind(statement, make([]interface{}, parameterCount))
+	q, err := ExecuteQueryWithContext(ctx, s.queryer, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	columns := make([]CatalogColumn, len(q.columns))
+	for i, name := range q.columns {
+		columns[i] = CatalogColumn{Name: name, Type: DBUnknown.String()}
+		if i < len(q.types) {
+			columns[i].DatabaseType = q.types[i].DatabaseTypeName()
+			columns[i].Type = MapDatabaseType(db.Driver, columns[i].DatabaseType).String()
+		}
+	}
+
+	return columns, nil
+}
+
+// BuildCatalog describes the configured endpoints.  When the databases are
+// given, the result columns of each endpoint's query are discovered by
+// executing the query for no rows.
+func BuildCatalog(ctx context.Context, config *Configuration, dbs Databases) Catalog {
+	catalog := Catalog{Endpoints: []CatalogEndpoint{}}
+
+	for name, endpoint := range config.Endpoints {
+		route := endpoint.Route(name)
+		inPath := routeParameters(route)
+
+		entry := CatalogEndpoint{
+			Name:       name,
+			Path:       route,
+			Query:      endpoint.QueryConfig,
+			Database:   config.Queries[endpoint.QueryConfig].DatabaseName(),
+			Mutating:   config.Queries[endpoint.QueryConfig].Mutating,
+			Parameters: []CatalogParameter{},
+			Formats:    endpointFormatNames(endpoint),
+			Roles:      endpoint.Roles,
+		}
+
+		parameterCount := 0
+		for pname, pdesc := range endpoint.Parameters {
+			in := "query"
+			if pdesc.FromPrincipal() {
+				in = "principal"
+			} else if inPath[pname] {
+				in = "path"
+			}
+
+			entry.Parameters = append(entry.Parameters, CatalogParameter{
+				Name:     pname,
+				In:       in,
+				Type:     pdesc.Type,
+				Items:    pdesc.Items,
+				Required: pdesc.Required || in == "path",
+				Default:  pdesc.Default,
+				Values:   pdesc.Values,
+				Layout:   pdesc.Layout,
+				Ordinal:  pdesc.Ordinal,
+			})
+
+			if pdesc.Ordinal > parameterCount {
+				parameterCount = pdesc.Ordinal
+			}
+		}
+
+		sort.Slice(entry.Parameters, func(i, j int) bool {
+			return entry.Parameters[i].Ordinal < entry.Parameters[j].Ordinal
+		})
+
+		if db, err := dbs.For(config.Queries[endpoint.QueryConfig]); err == nil {
+			queryCtx, cancel := withTimeout(ctx, config.QueryTimeout(config.Queries[endpoint.QueryConfig]))
+			columns, err := discoverColumns(queryCtx, db, config.Queries[endpoint.QueryConfig], parameterCount)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to discover the columns of %s: %v", name, err)
+			}
+			entry.Columns = columns
+		}
+
+		catalog.Endpoints = append(catalog.Endpoints, entry)
+	}
+
+	sort.Slice(catalog.Endpoints, func(i, j int) bool {
+		return catalog.Endpoints[i].Name < catalog.Endpoints[j].Name
+	})
+
+	return catalog
+}
+
+// The OpenAPI schema of a parameter type
+func parameterSchema(paramType string, p CatalogParameter) map[string]interface{} {
+	schema := map[string]interface{}{}
+
+	switch paramType {
+	case "number":
+		schema["type"] = "integer"
+		schema["format"] = "int64"
+	case "decimal":
+		schema["type"] = "string"
+		schema["format"] = "decimal"
+	case "boolean":
+		schema["type"] = "boolean"
+	case "date":
+		schema["type"] = "string"
+		schema["format"] = "date"
+	case "timestamp":
+		schema["type"] = "string"
+		schema["format"] = "date-time"
+	case "enum":
+		schema["type"] = "string"
+		schema["enum"] = p.Values
+	case "list":
+		schema["type"] = "array"
+		schema["items"] = parameterSchema(p.Items, p)
+	default:
+		schema["type"] = "string"
+	}
+
+	return schema
+}
+
+// The OpenAPI schema of a result column
+func columnSchema(c CatalogColumn) map[string]interface{} {
+	schema := map[string]interface{}{"nullable": true}
+
+	switch c.Type {
+	case DBNumber.String():
+		schema["type"] = "number"
+	case DBBoolean.String():
+		schema["type"] = "boolean"
+	case DBDate.String():
+		schema["type"] = "string"
+		schema["format"] = "date"
+	case DBTimestamp.String():
+		schema["type"] = "string"
+		schema["format"] = "date-time"
+	case DBUUID.String():
+		schema["type"] = "string"
+		schema["format"] = "uuid"
+	case DBJSON.String():
+		// Any JSON value
+	default:
+		schema["type"] = "string"
+	}
+
+	return schema
+}
+
+// The OpenAPI responses of an endpoint
+func endpointResponses(e CatalogEndpoint) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, c := range e.Columns {
+		properties[c.Name] = columnSchema(c)
+	}
+
+	rows := map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"type": "object", "properties": properties},
+	}
+
+	content := map[string]interface{}{}
+	for _, name := range e.Formats {
+		format, _ := LookupFormat(name)
+		switch name {
+		case "json":
+			content[format.MediaType] = map[string]interface{}{"schema": rows}
+		case "ndjson":
+			content[format.MediaType] = map[string]interface{}{"schema": rows["items"]}
+		case "xlsx":
+			content[format.MediaType] = map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string", "format": "binary"},
+			}
+		default:
+			content[format.MediaType] = map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"},
+			}
+		}
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{"description": "The query results", "content": content},
+		"400": map[string]interface{}{"description": "Missing or invalid parameters"},
+		"406": map[string]interface{}{"description": "None of the endpoint's formats is acceptable"},
+	}
+	if len(e.Roles) > 0 {
+		responses["403"] = map[string]interface{}{"description": "The caller does not have one of the endpoint's roles"}
+	}
+
+	return responses
+}
+
+// OpenAPI returns an OpenAPI 3 document describing the catalog's endpoints.
+func (c Catalog) OpenAPI() map[string]interface{} {
+	paths := map[string]interface{}{}
+
+	for _, e := range c.Endpoints {
+		parameters := []interface{}{}
+		for _, p := range e.Parameters {
+			if p.In == "principal" {
+				// Not passed by the caller
+				continue
+			}
+
+			parameter := map[string]interface{}{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required,
+				"schema":   parameterSchema(p.Type, p),
+			}
+			if p.Default != nil {
+				parameter["schema"].(map[string]interface{})["default"] = p.Default
+			}
+			if p.Type == "list" {
+				parameter["style"] = "form"
+				parameter["explode"] = false
+			}
+			parameters = append(parameters, parameter)
+		}
+
+		parameters = append(parameters, map[string]interface{}{
+			"name":   "format",
+			"in":     "query",
+			"schema": map[string]interface{}{"type": "string", "enum": e.Formats},
+		})
+
+		path := routeParameter.ReplaceAllString(e.Path, "{$1}")
+		paths[path] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": e.Name,
+				"summary":     fmt.Sprintf("Results of the %s query", e.Query),
+				"parameters":  parameters,
+				"responses":   endpointResponses(e),
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "wysci",
+			"version": "v1",
+		},
+		"paths": paths,
+	}
+}
+
+// Writes a value as a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// VisibleTo returns the catalog of the endpoints the principal may call,
+// leaving out those whose roles the principal has none of
+func (c Catalog) VisibleTo(p *Principal) Catalog {
+	visible := Catalog{Endpoints: []CatalogEndpoint{}}
+	for _, e := range c.Endpoints {
+		if len(e.Roles) == 0 || p.HasRole(e.Roles...) {
+			visible.Endpoints = append(visible.Endpoints, e)
+		}
+	}
+	return visible
+}
+
+// Builds the catalog of a router once, when it is first requested, so the
+// queries are not executed to discover their columns on every request.  A
+// reloaded configuration builds a new router and with it a new catalog.
+type catalogCache struct {
+	config  *Configuration
+	dbs     Databases
+	once    sync.Once
+	catalog Catalog
+}
+
+func (c *catalogCache) get() Catalog {
+	c.once.Do(func() {
+		// Not the request's context, which would leave the catalog
+		// without columns for good if the first client went away
+		c.catalog = BuildCatalog(context.Background(), c.config, c.dbs)
+	})
+	return c.catalog
+}
+
+func makeCatalogHandler(catalog *catalogCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := requestContext(r)
+		writeJSON(w, catalog.get().VisibleTo(PrincipalFromContext(ctx)))
+	}
+}
+
+func makeOpenAPIHandler(catalog *catalogCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := requestContext(r)
+		writeJSON(w, catalog.get().VisibleTo(PrincipalFromContext(ctx)).OpenAPI())
+	}
+}
@@ -0,0 +1,145 @@
+package wysci
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildCatalog(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Path = "/simple/:id"
+	endpoint.Formats = []string{"json", "csv"}
+	config.Endpoints["simple"] = endpoint
+
+	catalog := BuildCatalog(context.Background(), config, testDBs)
+	if len(catalog.Endpoints) != 1 {
+		t.Fatalf("Expected 1 endpoint but got %d", len(catalog.Endpoints))
+	}
+
+	e := catalog.Endpoints[0]
+	if e.Path != "/api/v1/simple/:id" || e.Query != "simple" {
+		t.Errorf("Unexpected endpoint %v", e)
+	}
+
+	if len(e.Parameters) != 1 || e.Parameters[0].In != "path" || !e.Parameters[0].Required {
+		t.Errorf("Expected a required path parameter but got %v", e.Parameters)
+	}
+
+	if len(e.Formats) != 2 || e.Formats[0] != "json" {
+		t.Errorf("Unexpected formats %v", e.Formats)
+	}
+
+	expected := []CatalogColumn{
+		{Name: "id", Type: "Number", DatabaseType: "int"},
+		{Name: "name", Type: "Text", DatabaseType: "varchar"},
+		{Name: "some_date", Type: "Date", DatabaseType: "date"},
+	}
+	if len(e.Columns) != len(expected) {
+		t.Fatalf("Expected %d columns but got %v", len(expected), e.Columns)
+	}
+	for i, c := range expected {
+		if e.Columns[i] != c {
+			t.Errorf("Expected column %v but got %v", c, e.Columns[i])
+		}
+	}
+}
+
+func TestCatalogEndpoints(t *testing.T) {
+	router, err := ConfigureEndpoints(testConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	var catalog Catalog
+	err = json.Unmarshal(w.Body.Bytes(), &catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Endpoints) != 1 || catalog.Endpoints[0].Name != "simple" {
+		t.Errorf("Unexpected catalog %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	var doc struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("Unexpected OpenAPI version %s", doc.OpenAPI)
+	}
+
+	if _, ok := doc.Paths["/api/v1/simple"]["get"]; !ok {
+		t.Errorf("Expected a GET operation for /api/v1/simple: %s", w.Body.String())
+	}
+}
+
+func TestOpenAPIPathParameters(t *testing.T) {
+	catalog := Catalog{Endpoints: []CatalogEndpoint{{
+		Name:       "sales",
+		Path:       "/api/v1/customers/:customerId/sales",
+		Parameters: []CatalogParameter{{Name: "customerId", In: "path", Type: "number", Required: true}},
+		Formats:    []string{"csv"},
+	}}}
+
+	paths := catalog.OpenAPI()["paths"].(map[string]interface{})
+	if _, ok := paths["/api/v1/customers/{customerId}/sales"]; !ok {
+		t.Errorf("Expected an OpenAPI path template but got %v", paths)
+	}
+}
+
+func TestCatalogVisibleToRoles(t *testing.T) {
+	config := apiKeyConfiguration()
+	config.Security.APIKey.Keys = append(config.Security.APIKey.Keys,
+		APIKey{Name: "accounts", Hash: hashKey("ledger"), Roles: []string{"finance"}})
+	endpoint := config.Endpoints["simple"]
+	endpoint.Path = "/restricted"
+	endpoint.Roles = []string{"finance"}
+	config.Endpoints["restricted"] = endpoint
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]int{"s3cret": 1, "ledger": 2} {
+		for _, path := range []string{"/api/v1", "/api/v1/openapi.json"} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", path+"?api_key="+key, nil))
+			if w.Code != 200 {
+				t.Fatalf("Expected 200 but got %d", w.Code)
+			}
+
+			var doc struct {
+				Endpoints []CatalogEndpoint      `json:"endpoints"`
+				Paths     map[string]interface{} `json:"paths"`
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(doc.Endpoints)+len(doc.Paths) != expected {
+				t.Errorf("Expected %d endpoints in %s for key %s: %s", expected, path, key, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/darcinc/wysci"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `Usage:
+  wysci [-config file] [-v] list
+  wysci [-config file] [-v] run <endpoint> [-format name] [-o file] [-<parameter> value ...]
+
+List the configured endpoints, or run one and write its results to a file
+or standard output.  The database settings come from the configuration and
+the DBHOST, DBUSER, DATABASE, DBPASS, and DBPORT environment variables.
+
+Options:
+`
+
+// Collects the values of a parameter flag, which can be repeated for a list
+type parameterFlag struct {
+	name   string
+	values url.Values
+}
+
+func (p parameterFlag) String() string {
+	if p.values == nil {
+		return ""
+	}
+	return strings.Join(p.values[p.name], ",")
+}
+
+func (p parameterFlag) Set(value string) error {
+	p.values.Add(p.name, value)
+	return nil
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "wysci: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// Writes a table of the configured endpoints
+func list(config *wysci.Configuration) {
+	catalog := wysci.BuildCatalog(context.Background(), config, nil)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPATH\tFORMATS\tPARAMETERS")
+	for _, e := range catalog.Endpoints {
+		parameters := []string{}
+		for _, p := range e.Parameters {
+			switch {
+			case p.In == "principal":
+				continue
+			case p.Required:
+				parameters = append(parameters, fmt.Sprintf("-%s %s (required)", p.Name, p.Type))
+			default:
+				parameters = append(parameters, fmt.Sprintf("-%s %s", p.Name, p.Type))
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Name, e.Path, strings.Join(e.Formats, ","), strings.Join(parameters, ", "))
+	}
+	w.Flush()
+}
+
+// Returns the name of the format with the extension of the output file
+func formatOfFile(path string) string {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	for _, name := range wysci.FormatNames() {
+		format, _ := wysci.LookupFormat(name)
+		if strings.EqualFold(format.Extension, ext) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Runs an endpoint with the parameters given as flags
+func run(config *wysci.Configuration, args []string) {
+	if len(args) == 0 {
+		fail("run needs an endpoint name")
+	}
+
+	name := args[0]
+	endpoint, ok := config.Endpoints[name]
+	if !ok {
+		fail("unknown endpoint %s", name)
+	}
+
+	flags := flag.NewFlagSet("run "+name, flag.ExitOnError)
+	format := flags.String("format", "", "The output format (defaults to the endpoint's first format or the output file's extension)")
+	output := flags.String("o", "", "The output file (defaults to standard output)")
+
+	values := url.Values{}
+	for pname, p := range endpoint.Parameters {
+		if p.FromPrincipal() {
+			continue
+		}
+		if flags.Lookup(pname) != nil {
+			fail("parameter %s of %s conflicts with the -%s option", pname, name, pname)
+		}
+		flags.Var(parameterFlag{name: pname, values: values}, pname, fmt.Sprintf("The %s parameter (%s)", pname, p.TypeName()))
+	}
+
+	flags.Parse(args[1:])
+	if flags.NArg() > 0 {
+		fail("unexpected arguments %s", strings.Join(flags.Args(), " "))
+	}
+
+	if *format == "" && *output != "" {
+		*format = formatOfFile(*output)
+	}
+
+	database := config.Database
+	database.ApplyEnvironment()
+	dbs, err := wysci.OpenDatabases(database, config.Databases)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer dbs.Close()
+
+	// Interrupting cancels the query
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		cancel()
+	}()
+
+	err = dbs.Ping(ctx, 1)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" {
+		file, err = os.Create(*output)
+		if err != nil {
+			fail("%v", err)
+		}
+		w = file
+	}
+
+	err = wysci.RunEndpoint(ctx, config, dbs, name, values, *format, w)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*output)
+		}
+	}
+
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+func main() {
+	configFile := flag.String("config", "", "The configuration to load (defaults to CONFIG or wysci.toml)")
+	verbose := flag.Bool("v", false, "Log the queries")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if !*verbose {
+		stdlog.SetOutput(ioutil.Discard)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG")
+	}
+	if *configFile == "" {
+		*configFile = "wysci.toml"
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := wysci.LoadConfiguration(*configFile)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		fail("invalid configuration:\n%v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		list(config)
+	case "run":
+		run(config, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/darcinc/wysci"
+	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func finalString(env, cmd, config, def string) string {
@@ -30,23 +35,6 @@ func finalString(env, cmd, config, def string) string {
 	return result
 }
 
-func finalInt(env, cmd, config, def int) int {
-	result := def
-	if config != 0 {
-		result = config
-	}
-
-	if env != 0 {
-		result = cmd
-	}
-
-	if cmd != 0 {
-		result = cmd
-	}
-
-	return result
-}
-
 func main() {
 
 	// TODO: Clean up the config code out of main
@@ -55,46 +43,156 @@ func main() {
 	cmdUser := flag.String("dbuser", "", "The database user")
 	cmdName := flag.String("database", "", "The database to connect to")
 	cmdPass := flag.String("dbpass", "", "The password for the database user")
-	cmdPort := flag.Int("dbport", 5432, "The database listening port")
+	cmdPort := flag.Int("dbport", 0, "The database listening port (default 5432)")
+	cmdWatch := flag.Duration("watch", 0, "How often to check the configuration for changes, 0 to only reload on SIGHUP")
 
 	flag.Parse()
 
 	envConf := os.Getenv("CONFIG")
-	envHost := os.Getenv("DBHOST")
-	envUser := os.Getenv("DBUSER")
-	envName := os.Getenv("DATABASE")
-	envPass := os.Getenv("DBPASS")
-	envPort, _ := strconv.Atoi(os.Getenv("DBPORT"))
 
 	configFile := finalString(envConf, *cmdConf, "", "wysci.toml")
 
 	config, err := wysci.LoadConfiguration(configFile)
 	if err != nil {
 		log.Printf("Failed to load configuration: %v", err)
+		os.Exit(1)
 	}
 
-	databaseHost := finalString(envHost, *cmdHost, config.Database.DBHost, "localhost")
-	databaseUser := finalString(envUser, *cmdUser, config.Database.DBUser, "postgres")
-	databasePass := finalString(envPass, *cmdPass, config.Database.DBPass, "")
-	databaseName := finalString(envName, *cmdName, config.Database.DBName, "postgres")
-	databasePort := finalInt(envPort, *cmdPort, config.Database.DBPort, 5432)
+	err = config.Validate()
+	if err != nil {
+		log.Printf("Invalid configuration:\n%v", err)
+		os.Exit(1)
+	}
 
-	connString := fmt.Sprintf("user=%s dbname=%s host=%s password=%s port=%d sslmode=disable",
-		databaseUser, databaseName, databaseHost, databasePass, databasePort)
-	conn, err := sql.Open("postgres", connString)
+	// The environment overrides the file and the command line overrides both
+	database := config.Database
+	database.ApplyEnvironment()
+	database.DBHost = finalString("", *cmdHost, database.DBHost, "")
+	database.DBUser = finalString("", *cmdUser, database.DBUser, "")
+	database.DBName = finalString("", *cmdName, database.DBName, "")
+	database.DBPass = finalString("", *cmdPass, database.DBPass, "")
+	if *cmdPort != 0 {
+		database.DBPort = *cmdPort
+	}
+
+	dbs, err := wysci.OpenDatabases(database, config.Databases)
 	if err != nil {
-		log.Printf("Failed to open database: %v", err)
+		log.Printf("%v", err)
 		os.Exit(1)
 	}
 
-	router, err := wysci.ConfigureEndpoints(config, conn)
+	// Fail at startup rather than on the first request when a database
+	// cannot be reached
+	attempts := config.Connection.ConnectAttempts
+	if attempts == 0 {
+		attempts = 5
+	}
+	err = dbs.Ping(context.Background(), attempts)
+	if err != nil {
+		log.Printf("%v", err)
+		dbs.Close()
+		os.Exit(1)
+	}
+
+	router, err := wysci.ConfigureEndpoints(config, dbs)
 	if err != nil {
 		log.Printf("Failed to create endpoints: %v", err)
+		os.Exit(1)
+	}
+
+	handler := wysci.NewSwappableHandler(router)
+	reloads := newReloader(configFile, config, dbs, handler)
+
+	shutdownTimeout := 30 * time.Second
+	if config.Connection.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(config.Connection.ShutdownTimeout)
+		if err != nil {
+			log.Printf("Invalid shutdown_timeout: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Every request context derives from baseContext, so canceling it
+	// cancels the queries still running when the shutdown deadline passes
+	baseContext, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Connection.Address, config.Connection.Port),
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return baseContext
+		},
+	}
+
+	if config.Connection.UsesTLS() {
+		server.TLSConfig, err = wysci.NewTLSConfig(config.Connection)
+		if err != nil {
+			log.Printf("Failed to load TLS certificates: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		if server.TLSConfig == nil {
+			log.Printf("Listening on %s", server.Addr)
+			stopped <- server.ListenAndServe()
+		} else {
+			log.Printf("Listening on %s with TLS", server.Addr)
+			stopped <- server.ListenAndServeTLS("", "")
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	if *cmdWatch > 0 {
+		go reloads.watch(*cmdWatch, done)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for stopping := false; !stopping; {
+		select {
+		case err = <-stopped:
+			log.Printf("Failed to serve: %v", err)
+			dbs.Close()
+			os.Exit(1)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloads.reload()
+				continue
+			}
+			log.Printf("Received %v, finishing requests for up to %v", sig, shutdownTimeout)
+			stopping = true
+		}
+	}
+
+	err = shutdown(server, cancelRequests, shutdownTimeout)
+	if err != nil {
+		log.Printf("Failed to finish requests: %v", err)
+	}
+
+	err = dbs.Close()
+	if err != nil {
+		log.Printf("Failed to close the databases: %v", err)
+	}
+	log.Printf("Stopped")
+}
+
+// Stops accepting connections and waits for the requests in flight to
+// finish.  When the timeout passes first, the remaining requests are
+// canceled, which cancels their queries, and their connections are closed.
+func shutdown(server *http.Server, cancelRequests context.CancelFunc, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		cancelRequests()
+		server.Close()
 	}
 
-	// TODO: Needs to run using HTTPS
-	http.ListenAndServe(
-		fmt.Sprintf("%s:%d", config.Connection.Address, config.Connection.Port),
-		router,
-	)
+	return err
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/darcinc/wysci"
+)
+
+// Reloads the configuration file into the server's handler.  Only the
+// queries, endpoints, and security are reloaded, the database and
+// connection settings take effect on restart, so a reloaded query can only
+// use a database the server was started with.
+type reloader struct {
+	path    string
+	dbs     wysci.Databases
+	handler *wysci.SwappableHandler
+
+	mutex   sync.Mutex
+	config  *wysci.Configuration
+	modTime time.Time
+}
+
+func newReloader(path string, config *wysci.Configuration, dbs wysci.Databases, handler *wysci.SwappableHandler) *reloader {
+	r := &reloader{path: path, dbs: dbs, handler: handler, config: config}
+	if info, err := os.Stat(path); err == nil {
+		r.modTime = info.ModTime()
+	}
+	return r
+}
+
+// Loads the configuration and swaps in its endpoints.  An invalid
+// configuration is logged and the server keeps the current endpoints.
+func (r *reloader) reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime = info.ModTime()
+	}
+
+	config, err := wysci.LoadConfiguration(r.path)
+	if err != nil {
+		log.Printf("Keeping the current configuration: %v", err)
+		return
+	}
+
+	err = config.Validate()
+	if err != nil {
+		log.Printf("Keeping the current configuration, it is invalid:\n%v", err)
+		return
+	}
+
+	router, err := wysci.ConfigureEndpoints(config, r.dbs)
+	if err != nil {
+		log.Printf("Keeping the current configuration: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(config.Database, r.config.Database) || !reflect.DeepEqual(config.Databases, r.config.Databases) ||
+		config.Connection != r.config.Connection {
+		log.Printf("The database and connection settings take effect on restart")
+	}
+
+	r.handler.Swap(router)
+	r.config = config
+	log.Printf("Reloaded %s", r.path)
+}
+
+// Reloads the configuration when the file's modification time changes
+func (r *reloader) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				log.Printf("Failed to check %s: %v", r.path, err)
+				continue
+			}
+
+			r.mutex.Lock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mutex.Unlock()
+
+			if changed {
+				r.reload()
+			}
+		}
+	}
+}
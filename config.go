@@ -1,76 +1,336 @@
 package wysci
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
-// DBConfig is a database connection configuration
+// DBConfig is a database connection configuration.  The connection is
+// described by the discrete settings or by the driver's own data source
+// name, which takes precedence.
 type DBConfig struct {
+	Driver string `toml:"driver,omitempty"`
+	DSN    string `toml:"dsn,omitempty"`
 	DBHost string `toml:"host,omitempty"`
 	DBUser string `toml:"user,omitempty"`
 	DBPass string `toml:"password,omitempty"`
 	DBName string `toml:"database,omitempty"`
 	DBPort int    `toml:"port,omitempty"`
+
+	MaxOpen        int    `toml:"max_open,omitempty"`
+	MaxIdle        int    `toml:"max_idle,omitempty"`
+	MaxLifetime    string `toml:"max_lifetime,omitempty"`
+	ConnectTimeout string `toml:"connect_timeout,omitempty"`
+
+	SSLMode     string `toml:"ssl_mode,omitempty"`
+	SSLRootCert string `toml:"ssl_root_cert,omitempty"`
+	SSLCert     string `toml:"ssl_cert,omitempty"`
+	SSLKey      string `toml:"ssl_key,omitempty"`
+}
+
+// DriverName returns the database/sql driver of the settings, postgres
+// unless another is set
+func (d DBConfig) DriverName() string {
+	if d.Driver == "" {
+		return DriverPostgres
+	}
+	return d.Driver
+}
+
+// ApplyEnvironment overrides the settings with the DBHOST, DBUSER,
+// DATABASE, DBPASS, and DBPORT environment variables that are set.
+func (d *DBConfig) ApplyEnvironment() {
+	for name, setting := range map[string]*string{
+		"DBHOST":   &d.DBHost,
+		"DBUSER":   &d.DBUser,
+		"DATABASE": &d.DBName,
+		"DBPASS":   &d.DBPass,
+	} {
+		if value := os.Getenv(name); value != "" {
+			*setting = value
+		}
+	}
+
+	if port, err := strconv.Atoi(os.Getenv("DBPORT")); err == nil && port != 0 {
+		d.DBPort = port
+	}
+}
+
+// The name of the MySQL driver's TLS configuration for the SSL settings.
+// Certificates need a configuration registered under a name of their own.
+func (d DBConfig) mysqlTLS() string {
+	if d.SSLMode == "disable" {
+		return "false"
+	}
+
+	if d.SSLRootCert != "" || d.SSLCert != "" {
+		sum := sha256.Sum256([]byte(strings.Join([]string{d.SSLMode, d.SSLRootCert, d.SSLCert, d.SSLKey}, "\x00")))
+		return mysqlTLSPrefix + hex.EncodeToString(sum[:8])
+	}
+
+	switch d.SSLMode {
+	case "prefer":
+		return "preferred"
+	case "require":
+		return "skip-verify"
+	case "verify-ca", "verify-full":
+		return "true"
+	}
+	return ""
+}
+
+// Parses a duration setting, which is 0 when not set
+func optionalDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Quotes a Postgres connection string value that is empty or holds spaces,
+// quotes, or backslashes
+func postgresValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " '\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value) + "'"
+}
+
+// ConnectionString returns the data source name of the settings for their
+// driver.  Postgres settings that are not set default to the postgres user
+// and database on localhost:5432 without SSL, and MySQL settings to the
+// root user on localhost:3306.  A SQLite database is the file named by the
+// database setting.
+func (d DBConfig) ConnectionString() string {
+	if d.DSN != "" {
+		return d.DSN
+	}
+
+	host, user, name, port := d.DBHost, d.DBUser, d.DBName, d.DBPort
+	if host == "" {
+		host = "localhost"
+	}
+
+	// A timeout that does not parse is reported by Validate
+	timeout, _ := optionalDuration(d.ConnectTimeout)
+
+	switch d.DriverName() {
+	case DriverSQLite:
+		return name
+	case DriverMySQL:
+		if user == "" {
+			user = "root"
+		}
+		if port == 0 {
+			port = 3306
+		}
+		credentials := user
+		if d.DBPass != "" {
+			credentials += ":" + d.DBPass
+		}
+
+		options := url.Values{}
+		if timeout > 0 {
+			options.Set("timeout", timeout.String())
+		}
+		if tls := d.mysqlTLS(); tls != "" {
+			options.Set("tls", tls)
+		}
+
+		dsn := fmt.Sprintf("%s@tcp(%s)/%s", credentials, net.JoinHostPort(host, strconv.Itoa(port)), name)
+		if len(options) > 0 {
+			dsn += "?" + options.Encode()
+		}
+		return dsn
+	}
+
+	if user == "" {
+		user = "postgres"
+	}
+	if name == "" {
+		name = "postgres"
+	}
+	if port == 0 {
+		port = 5432
+	}
+	sslMode := d.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	dsn := fmt.Sprintf("user=%s dbname=%s host=%s password=%s port=%d sslmode=%s",
+		postgresValue(user), postgresValue(name), postgresValue(host), postgresValue(d.DBPass), port, sslMode)
+
+	for _, option := range []struct{ key, value string }{
+		{"sslrootcert", d.SSLRootCert},
+		{"sslcert", d.SSLCert},
+		{"sslkey", d.SSLKey},
+	} {
+		if option.value != "" {
+			dsn += fmt.Sprintf(" %s=%s", option.key, postgresValue(option.value))
+		}
+	}
+
+	if timeout > 0 {
+		dsn += fmt.Sprintf(" connect_timeout=%d", int(math.Ceil(timeout.Seconds())))
+	}
+
+	return dsn
 }
 
 // QueryConfig describes a query to execute
 type QueryConfig struct {
-	SQL    string `toml:"sql,omitempty"`
-	Break  string `toml:"break,omitempty"`
-	Params string `toml:"params,omitempty"`
+	SQL      string `toml:"sql,omitempty"`
+	Break    string `toml:"break,omitempty"`
+	Children string `toml:"children,omitempty"`
+	Params   string `toml:"params,omitempty"`
+	Database string `toml:"database,omitempty"`
+	Timeout  string `toml:"timeout,omitempty"`
+	Mutating bool   `toml:"mutating,omitempty"`
+}
+
+// QueryTimeout returns how long the query can run, which is its own timeout
+// or, without one, the query_timeout of the connection.  0 is no limit.
+func (c *Configuration) QueryTimeout(q QueryConfig) time.Duration {
+	timeout := c.Connection.QueryTimeout
+	if q.Timeout != "" {
+		timeout = q.Timeout
+	}
+
+	// A timeout that does not parse is reported by Validate
+	d, _ := optionalDuration(timeout)
+	return d
 }
 
 // Service describes the service endpoint
 type Service struct {
-	Address string `toml:"address"`
-	Port    int    `toml:"port"`
+	Address    string `toml:"address"`
+	Port       int    `toml:"port"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+	MinTLS     string `toml:"min_tls"`
+	ClientCA   string `toml:"client_ca"`
+	ClientAuth string `toml:"client_auth"`
+
+	ShutdownTimeout string `toml:"shutdown_timeout"`
+	ConnectAttempts int    `toml:"connect_attempts"`
+	QueryTimeout    string `toml:"query_timeout"`
 }
 
 // Parameter is an endpoint parameter
 type Parameter struct {
-	Type     string `toml:"type"`
-	Required string `toml:"required"`
-	Ordinal  int    `toml:"ordinal"`
+	Type     string      `toml:"type"`
+	Required bool        `toml:"required"`
+	Default  interface{} `toml:"default"`
+	Ordinal  int         `toml:"ordinal"`
+	Layout   string      `toml:"layout"`
+	Values   []string    `toml:"values"`
+	Items    string      `toml:"items"`
+	Source   string      `toml:"source"`
 }
 
 // Endpoint describe a service endpoint
 type Endpoint struct {
 	QueryConfig string               `toml:"query"`
+	Path        string               `toml:"path"`
 	Parameters  map[string]Parameter `toml:"parameters"`
 	Headers     map[string]string    `toml:"headers"`
+	Formats     []string             `toml:"formats"`
+	Sheet       string               `toml:"sheet"`
+	BreakStyle  string               `toml:"break_style"`
+	Roles       []string             `toml:"roles"`
+	Settings    map[string]string    `toml:"settings"`
+}
+
+// APIKey is a named API key.  Only the hex SHA-256 hash of the key is kept.
+type APIKey struct {
+	Name  string   `toml:"name"`
+	Hash  string   `toml:"hash"`
+	Roles []string `toml:"roles"`
+}
+
+// APIKeyConfig configures API key authentication
+type APIKeyConfig struct {
+	Header   string   `toml:"header"`
+	Query    string   `toml:"query"`
+	Keys     []APIKey `toml:"keys"`
+	KeysFile string   `toml:"keys_file"`
+}
+
+// ProxyConfig configures authentication by a trusted reverse proxy
+type ProxyConfig struct {
+	UserHeader   string   `toml:"user_header"`
+	GroupsHeader string   `toml:"groups_header"`
+	Trusted      []string `toml:"trusted"`
+}
+
+// JWTConfig configures bearer token authentication
+type JWTConfig struct {
+	JWKSFile   string `toml:"jwks_file"`
+	PEMFile    string `toml:"pem_file"`
+	Issuer     string `toml:"issuer"`
+	Audience   string `toml:"audience"`
+	UserClaim  string `toml:"user_claim"`
+	RolesClaim string `toml:"roles_claim"`
+}
+
+// Security configures how requests are authenticated
+type Security struct {
+	Methods []string     `toml:"methods"`
+	APIKey  APIKeyConfig `toml:"apikey"`
+	Proxy   ProxyConfig  `toml:"proxy"`
+	JWT     JWTConfig    `toml:"jwt"`
 }
 
 // Configuration defines a wysci server
 type Configuration struct {
 	Database   DBConfig               `toml:"database"`
+	Databases  map[string]DBConfig    `toml:"databases"`
 	Queries    map[string]QueryConfig `toml:"queries"`
 	Connection Service                `toml:"connection"`
-	Endpoints  map[string]Endpoint    `tomls:"endpoints"`
+	Security   Security               `toml:"security"`
+	Endpoints  map[string]Endpoint    `toml:"endpoints"`
+
+	source configSource
 }
 
-// LoadConfiguration loads the server
+// LoadConfiguration loads the server configuration.  It only reports
+// errors parsing the file, Validate checks the settings.
 func LoadConfiguration(path string) (*Configuration, error) {
 	log.Println("Reading TOML")
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
 		return nil, err
 	}
 
-	// config := make(map[string]interface{})
 	config := Configuration{}
-	_, err = toml.Decode(string(data), &config)
+	md, err := toml.Decode(string(data), &config)
 	if err != nil {
-		fmt.Printf("Error parsing toml: %v\n", err)
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+
+	config.source = configSource{
+		path:      path,
+		lines:     keyLines(string(data)),
+		undecoded: md.Undecoded(),
 	}
 
 	return &config, nil
@@ -0,0 +1,179 @@
+package wysci
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadConfiguration(t *testing.T) {
+	config, err := LoadConfiguration("docs/example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := config.Queries["customerSales"]; !ok {
+		t.Error("Expected the customerSales query")
+	}
+
+	if config.Connection.Port != 9000 {
+		t.Errorf("Expected port 9000 but got %d", config.Connection.Port)
+	}
+}
+
+func TestLoadConfigurationErrors(t *testing.T) {
+	if _, err := LoadConfiguration("missing.toml"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+
+	path := writeTempFile(t, "wysci-config", []byte("[queries.broken]\nsql = \n"))
+	defer os.Remove(path)
+
+	if _, err := LoadConfiguration(path); err == nil {
+		t.Error("Expected an error for invalid toml")
+	}
+}
+
+func TestValidateExample(t *testing.T) {
+	config, err := LoadConfiguration("docs/example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = config.Validate(); err != nil {
+		t.Errorf("Expected the example to be valid:\n%v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	path := writeTempFile(t, "wysci-config", []byte(`[queries.sales]
+sql = """
+    select * from sales
+    where customer_id = $1 and region = $3"""
+colour = "blue"
+
+[endpoints.sales]
+query = "sales"
+formats = ["csv", "pdf"]
+[endpoints.sales.parameters.customerId]
+type = "number"
+ordinal = 1
+[endpoints.sales.parameters.region]
+type = "text"
+ordinal = 2
+[endpoints.sales.parameters.other]
+type = "string"
+ordinal = 2
+
+[endpoints.missing]
+query = "nothing"
+`))
+	defer os.Remove(path)
+
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Endpoints) != 2 {
+		t.Fatalf("Expected 2 endpoints but got %d", len(config.Endpoints))
+	}
+
+	err = config.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors but got %v", err)
+	}
+
+	expected := []struct {
+		line    int
+		key     string
+		message string
+	}{
+		{5, "queries.sales.colour", "unknown setting"},
+		{7, "endpoints.sales", "no parameter has ordinal 3 for $3 of query sales"},
+		{9, "endpoints.sales.formats", `unknown format "pdf"`},
+		{14, "endpoints.sales.parameters.region.type", `unknown parameter type "text"`},
+		{15, "endpoints.sales.parameters.region.ordinal", "ordinal 2 is also used by other"},
+		{15, "endpoints.sales.parameters.region.ordinal", "query sales has no $2"},
+		{18, "endpoints.sales.parameters.other.ordinal", "query sales has no $2"},
+		{21, "endpoints.missing.query", `unknown query "nothing"`},
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors but got:\n%v", len(expected), errs)
+	}
+
+	for i, e := range expected {
+		if errs[i].Line != e.line || errs[i].Key != e.key || errs[i].Message != e.message {
+			t.Errorf("Expected %d: %s: %s but got %v", e.line, e.key, e.message, errs[i])
+		}
+	}
+
+	if errs[0].Error() != path+":5: queries.sales.colour: unknown setting" {
+		t.Errorf("Unexpected error text %s", errs[0].Error())
+	}
+}
+
+func TestValidateDefaultsAndPath(t *testing.T) {
+	path := writeTempFile(t, "wysci-config", []byte(`[queries.orders]
+sql = "select * from orders where id = $1 and placed >= $2 and status = any($3)"
+
+[endpoints.orders]
+query = "orders"
+path = "/orders/:idd"
+[endpoints.orders.parameters.id]
+type = "number"
+ordinal = 1
+[endpoints.orders.parameters.since]
+type = "date"
+ordinal = 2
+default = "yesterday"
+[endpoints.orders.parameters.status]
+type = "list"
+items = "enum"
+values = ["open", "closed"]
+ordinal = 3
+default = ["open", "lost"]
+`))
+	defer os.Remove(path)
+
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok {
+		t.Fatal("Expected ConfigErrors")
+	}
+
+	expected := []struct {
+		line int
+		key  string
+	}{
+		{6, "endpoints.orders.path"},
+		{13, "endpoints.orders.parameters.since.default"},
+		{19, "endpoints.orders.parameters.status.default"},
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors but got:\n%v", len(expected), errs)
+	}
+
+	for i, e := range expected {
+		if errs[i].Line != e.line || errs[i].Key != e.key {
+			t.Errorf("Expected %d: %s but got %v", e.line, e.key, errs[i])
+		}
+	}
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	config := testConfiguration()
+	config.Connection.QueryTimeout = "a while"
+	config.Queries["simple"] = QueryConfig{SQL: config.Queries["simple"].SQL, Timeout: "-5s"}
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok || len(errs) != 2 || errs[0].Key != "connection.query_timeout" || errs[1].Key != "queries.simple.timeout" {
+		t.Errorf("Expected errors for both timeouts but got %v", config.Validate())
+	}
+}
@@ -0,0 +1,352 @@
+package wysci
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DefaultDatabase names the database of the [database] section, which a
+// query uses unless it names another database
+const DefaultDatabase = "default"
+
+// The database/sql drivers a database can be configured with
+const (
+	// DriverPostgres is the lib/pq Postgres driver
+	DriverPostgres = "postgres"
+	// DriverSQLite is the go-sqlite3 SQLite driver
+	DriverSQLite = "sqlite3"
+	// DriverMySQL is the go-sql-driver MySQL driver
+	DriverMySQL = "mysql"
+)
+
+// The SSL modes of each driver, as named by Postgres. lib/pq does not support
+// the allow and prefer modes
+var sslModes = map[string]map[string]bool{
+	DriverPostgres: {"disable": true, "require": true, "verify-ca": true, "verify-full": true},
+	DriverMySQL:    {"disable": true, "prefer": true, "require": true, "verify-ca": true, "verify-full": true},
+}
+
+// The prefix of the TLS configurations registered with the MySQL driver
+const mysqlTLSPrefix = "wysci-"
+
+// The wait after the first failed ping of a database, which doubles after
+// each further failure
+var pingBackoff = time.Second
+
+// The drivers a database can be configured with
+var drivers = map[string]bool{
+	DriverPostgres: true,
+	DriverSQLite:   true,
+	DriverMySQL:    true,
+}
+
+// Database is the connection pool of a database with the driver it was
+// opened with, which decides how the $n placeholders of a query are passed
+type Database struct {
+	*sql.DB
+	Driver string
+}
+
+// Databases holds the connection pool of each configured database by name
+type Databases map[string]Database
+
+// DatabaseName returns the name of the database the query runs on
+func (q QueryConfig) DatabaseName() string {
+	if q.Database == "" {
+		return DefaultDatabase
+	}
+	return q.Database
+}
+
+// For returns the database the query runs on
+func (d Databases) For(q QueryConfig) (Database, error) {
+	db, ok := d[q.DatabaseName()]
+	if !ok {
+		return Database{}, fmt.Errorf("Unknown database %s", q.DatabaseName())
+	}
+	return db, nil
+}
+
+// Names returns the names of the databases in order
+func (d Databases) Names() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every connection pool
+func (d Databases) Close() error {
+	var first error
+	for _, db := range d {
+		err := db.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Rebind rewrites the $n placeholders of a query for the database's driver.
+// Postgres takes the query as written.  SQLite takes ?n, which binds by
+// number where $n binds in the order the names first appear.  MySQL only
+// takes ?, so the arguments are repeated and reordered to match the
+// placeholders.  Placeholders in quoted strings and comments are kept.
+func (d Database) Rebind(query string, args []interface{}) (string, []interface{}) {
+	if d.Driver != DriverSQLite && d.Driver != DriverMySQL {
+		return query, args
+	}
+
+	b := strings.Builder{}
+	rebound := []interface{}{}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				end = len(query) - i - 2
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+			continue
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			b.WriteString(query[i : i+end+4])
+			i += end + 3
+			continue
+		case c != '$':
+			b.WriteByte(c)
+			continue
+		}
+
+		digits := i + 1
+		for digits < len(query) && query[digits] >= '0' && query[digits] <= '9' {
+			digits++
+		}
+		n, err := strconv.Atoi(query[i+1 : digits])
+		if err != nil || n < 1 || n > len(args) {
+			b.WriteByte(c)
+			continue
+		}
+
+		if d.Driver == DriverSQLite {
+			b.WriteString("?" + query[i+1:digits])
+		} else {
+			b.WriteString("?")
+			rebound = append(rebound, args[n-1])
+		}
+		i = digits - 1
+	}
+
+	if d.Driver == DriverSQLite {
+		return b.String(), args
+	}
+	return b.String(), rebound
+}
+
+// The TLS configuration of MySQL settings with certificates.  The server's
+// certificate is verified against the root certificate, and its host name
+// as well with verify-full.  Without a root certificate verify-ca verifies
+// both against the system's roots, as it does without any certificates.
+func mysqlTLSConfig(config DBConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config.SSLRootCert != "" {
+		data, err := ioutil.ReadFile(config.SSLRootCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates in %s", config.SSLRootCert)
+		}
+	}
+
+	if config.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.SSLCert, config.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	fullyVerified := config.SSLMode == "verify-full" || config.SSLMode == "verify-ca" && config.SSLRootCert == ""
+	if !fullyVerified {
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if roots == nil {
+				return nil
+			}
+
+			certs := make([]*x509.Certificate, len(raw))
+			for i, der := range raw {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("The server sent no certificate")
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Registers the TLS configuration of MySQL settings with certificates
+func registerMySQLTLS(config DBConfig) error {
+	name := config.mysqlTLS()
+	if !strings.HasPrefix(name, mysqlTLSPrefix) {
+		return nil
+	}
+
+	tlsConfig, err := mysqlTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	return mysql.RegisterTLSConfig(name, tlsConfig)
+}
+
+// Opens the connection pool of a database with its pool settings
+func openDatabase(name string, config DBConfig) (Database, error) {
+	driver := config.DriverName()
+	if !drivers[driver] {
+		return Database{}, fmt.Errorf("Unknown driver %s for database %s", driver, name)
+	}
+
+	lifetime, err := optionalDuration(config.MaxLifetime)
+	if err != nil {
+		return Database{}, fmt.Errorf("Invalid max_lifetime for database %s: %v", name, err)
+	}
+	if _, err = optionalDuration(config.ConnectTimeout); err != nil {
+		return Database{}, fmt.Errorf("Invalid connect_timeout for database %s: %v", name, err)
+	}
+
+	if driver == DriverMySQL {
+		err = registerMySQLTLS(config)
+		if err != nil {
+			return Database{}, fmt.Errorf("Failed to load the certificates of database %s: %v", name, err)
+		}
+	}
+
+	dsn := config.ConnectionString()
+	if dsn == "" {
+		return Database{}, fmt.Errorf("Database %s has no %s database file", name, driver)
+	}
+
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return Database{}, fmt.Errorf("Failed to open database %s: %v", name, err)
+	}
+
+	conn.SetMaxOpenConns(config.MaxOpen)
+	if config.MaxIdle > 0 {
+		conn.SetMaxIdleConns(config.MaxIdle)
+	}
+	conn.SetConnMaxLifetime(lifetime)
+
+	return Database{DB: conn, Driver: driver}, nil
+}
+
+// OpenDatabases opens a connection pool for the default database and one
+// for each of the named databases.  The pools connect when they are first
+// used, or when they are pinged.
+func OpenDatabases(main DBConfig, named map[string]DBConfig) (Databases, error) {
+	dbs := Databases{}
+
+	open := func(name string, config DBConfig) error {
+		db, err := openDatabase(name, config)
+		if err != nil {
+			return err
+		}
+		dbs[name] = db
+		return nil
+	}
+
+	err := open(DefaultDatabase, main)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, config := range named {
+		if name == DefaultDatabase {
+			dbs.Close()
+			return nil, fmt.Errorf("The database name %s is reserved for the [database] section", DefaultDatabase)
+		}
+
+		err = open(name, config)
+		if err != nil {
+			dbs.Close()
+			return nil, err
+		}
+	}
+
+	return dbs, nil
+}
+
+// Ping checks that every database can be reached.  A database that cannot
+// is tried again until the number of attempts is reached, waiting twice as
+// long after each failure.
+func (d Databases) Ping(ctx context.Context, attempts int) error {
+	for _, name := range d.Names() {
+		db := d[name]
+		wait := pingBackoff
+
+		for attempt := 1; ; attempt++ {
+			err := db.PingContext(ctx)
+			if err == nil {
+				break
+			}
+
+			if attempt >= attempts {
+				return fmt.Errorf("Database %s (%s) is not reachable after %d attempts: %v", name, db.Driver, attempt, err)
+			}
+
+			log.Printf("Database %s is not reachable, trying again in %v: %v", name, wait, err)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("Database %s (%s) is not reachable: %v", name, db.Driver, err)
+			case <-time.After(wait):
+			}
+			wait *= 2
+		}
+	}
+
+	return nil
+}
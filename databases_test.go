@@ -0,0 +1,334 @@
+package wysci
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"database/sql"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultipleDatabases(t *testing.T) {
+	other, err := sql.Open("sqlite3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// Every connection to an unnamed sqlite database is a new database
+	other.SetMaxOpenConns(1)
+	_, err = other.Exec(`create table warehouses (id int, city varchar);
+		insert into warehouses values (1, 'Albany');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfiguration()
+	config.Databases = map[string]DBConfig{"warehouse": {}}
+	config.Queries["warehouses"] = QueryConfig{SQL: "select id, city from warehouses", Database: "warehouse"}
+	config.Endpoints["warehouses"] = Endpoint{QueryConfig: "warehouses"}
+
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := Databases{DefaultDatabase: testDBs[DefaultDatabase], "warehouse": {DB: other, Driver: DriverSQLite}}
+	router, err := ConfigureEndpoints(config, dbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/warehouses", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Albany") {
+		t.Errorf("Expected the warehouse database: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=4", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "embedded,comma") {
+		t.Errorf("Expected the default database: %d %s", w.Code, w.Body.String())
+	}
+
+	catalog := BuildCatalog(context.Background(), config, dbs)
+	databases := map[string]string{}
+	for _, e := range catalog.Endpoints {
+		databases[e.Name] = e.Database
+	}
+	if databases["warehouses"] != "warehouse" || databases["simple"] != DefaultDatabase {
+		t.Errorf("Unexpected catalog databases %v", databases)
+	}
+
+	if _, err = ConfigureEndpoints(config, testDBs); err == nil {
+		t.Error("Expected an error for a database that is not open")
+	}
+}
+
+func TestValidateDatabases(t *testing.T) {
+	config := testConfiguration()
+	config.Database.Driver = "oracle"
+	config.Databases = map[string]DBConfig{DefaultDatabase: {}}
+	config.Queries["simple"] = QueryConfig{SQL: "select $1", Database: "finance"}
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Errorf("Expected errors for the driver and the reserved and unknown databases but got %v", errs)
+	}
+}
+
+func TestValidatePostgresOnlyFeatures(t *testing.T) {
+	config := testConfiguration()
+	config.Databases = map[string]DBConfig{"local": {Driver: DriverSQLite, DBName: "local.db"}}
+	config.Queries["simple"] = QueryConfig{SQL: "select * from test_simple where id = any($1)", Database: "local"}
+	config.Endpoints["simple"] = Endpoint{
+		QueryConfig: "simple",
+		Parameters:  map[string]Parameter{"id": {Type: "list", Items: "number", Ordinal: 1}},
+		Settings:    map[string]string{"role": "reporting"},
+	}
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok || len(errs) != 2 || errs[0].Key != "endpoints.simple.parameters.id.type" || errs[1].Key != "endpoints.simple.settings" {
+		t.Errorf("Expected errors for the list parameter and the settings but got %v", config.Validate())
+	}
+
+	config.Databases["local"] = DBConfig{}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected Postgres to allow them but got %v", err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "select * from t where a = $2 and b = $1 and c = $2 and d = '$1' -- $2\n/* $1 */"
+	args := []interface{}{"one", "two"}
+
+	statement, rebound := Database{Driver: DriverPostgres}.Rebind(query, args)
+	if statement != query || !reflect.DeepEqual(rebound, args) {
+		t.Errorf("Expected the postgres query unchanged but got %s %v", statement, rebound)
+	}
+
+	statement, rebound = Database{Driver: DriverSQLite}.Rebind(query, args)
+	expected := "select * from t where a = ?2 and b = ?1 and c = ?2 and d = '$1' -- $2\n/* $1 */"
+	if statement != expected || !reflect.DeepEqual(rebound, args) {
+		t.Errorf("Expected %s but got %s %v", expected, statement, rebound)
+	}
+
+	statement, rebound = Database{Driver: DriverMySQL}.Rebind(query, args)
+	expected = "select * from t where a = ? and b = ? and c = ? and d = '$1' -- $2\n/* $1 */"
+	if statement != expected || !reflect.DeepEqual(rebound, []interface{}{"two", "one", "two"}) {
+		t.Errorf("Expected %s but got %s %v", expected, statement, rebound)
+	}
+
+	statement, _ = Database{Driver: DriverMySQL}.Rebind("select 'it''s $1', $1 from \"a$1\" where x = 'open $1", args)
+	if statement != "select 'it''s $1', ? from \"a$1\" where x = 'open $1" {
+		t.Errorf("Unexpected query %s", statement)
+	}
+}
+
+func TestSQLitePlaceholderOrder(t *testing.T) {
+	config := testConfiguration()
+	config.Queries["reversed"] = QueryConfig{SQL: "select $2 as second, $1 as first"}
+	config.Endpoints["reversed"] = Endpoint{
+		QueryConfig: "reversed",
+		Parameters: map[string]Parameter{
+			"first":  {Type: "string", Ordinal: 1},
+			"second": {Type: "string", Ordinal: 2},
+		},
+	}
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/reversed?first=a&second=b", nil))
+	if lines := strings.Split(w.Body.String(), "\r\n"); len(lines) < 2 || lines[1] != "b,a" {
+		t.Errorf("Expected the parameters by ordinal: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+	expected := map[string]DBConfig{
+		"user=postgres dbname=postgres host=localhost password='' port=5432 sslmode=disable":                    {},
+		"user=postgres dbname=postgres host=localhost password='it\\'s a \\\\secret' port=5432 sslmode=disable": {DBPass: `it's a \secret`},
+		"user=postgres dbname=postgres host=db password='' port=5432 sslmode=verify-full sslrootcert=/etc/ca.pem sslcert=/etc/client.pem sslkey=/etc/client.key connect_timeout=3": {
+			DBHost: "db", SSLMode: "verify-full", SSLRootCert: "/etc/ca.pem", SSLCert: "/etc/client.pem", SSLKey: "/etc/client.key", ConnectTimeout: "2500ms",
+		},
+		"root@tcp(localhost:3306)/?timeout=5s&tls=skip-verify": {Driver: DriverMySQL, ConnectTimeout: "5s", SSLMode: "require"},
+		"root@tcp(localhost:3306)/?tls=false":                  {Driver: DriverMySQL, SSLMode: "disable"},
+		"host=db.example.com":                                  {DSN: "host=db.example.com", DBHost: "ignored"},
+		"/var/lib/wysci/sales.db":                              {Driver: DriverSQLite, DBName: "/var/lib/wysci/sales.db"},
+		"root@tcp(localhost:3306)/":                            {Driver: DriverMySQL},
+		"jsmith:s3cret@tcp(db:3307)/sales":                     {Driver: DriverMySQL, DBHost: "db", DBPort: 3307, DBUser: "jsmith", DBPass: "s3cret", DBName: "sales"},
+		"root@tcp([::1]:3306)/inventory":                       {Driver: DriverMySQL, DBHost: "::1", DBName: "inventory"},
+	}
+
+	for dsn, config := range expected {
+		if config.ConnectionString() != dsn {
+			t.Errorf("Expected %s but got %s", dsn, config.ConnectionString())
+		}
+	}
+}
+
+func TestOpenDatabases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wysci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	main := DBConfig{Driver: DriverSQLite, DBName: filepath.Join(dir, "main.db")}
+	dbs, err := OpenDatabases(main, map[string]DBConfig{
+		"hr": {Driver: DriverSQLite, DSN: "file:" + filepath.Join(dir, "hr.db")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbs.Close()
+
+	if names := dbs.Names(); len(names) != 2 || names[0] != DefaultDatabase || names[1] != "hr" {
+		t.Errorf("Unexpected databases %v", names)
+	}
+
+	for _, name := range dbs.Names() {
+		if dbs[name].Driver != DriverSQLite {
+			t.Errorf("Expected %s to use sqlite3 but got %s", name, dbs[name].Driver)
+		}
+		if err = dbs[name].Ping(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = OpenDatabases(DBConfig{Driver: "oracle"}, nil); err == nil {
+		t.Error("Expected an error for an unknown driver")
+	}
+
+	if _, err = OpenDatabases(DBConfig{Driver: DriverSQLite}, nil); err == nil {
+		t.Error("Expected an error for a sqlite3 database without a file")
+	}
+}
+
+func TestDatabasePool(t *testing.T) {
+	dbs, err := OpenDatabases(DBConfig{Driver: DriverSQLite, DSN: "file::memory:", MaxOpen: 3, MaxLifetime: "1m"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbs.Close()
+
+	if max := dbs[DefaultDatabase].Stats().MaxOpenConnections; max != 3 {
+		t.Errorf("Expected 3 open connections at most but got %d", max)
+	}
+
+	_, err = OpenDatabases(DBConfig{Driver: DriverSQLite, DSN: "file::memory:", MaxLifetime: "forever"}, nil)
+	if err == nil {
+		t.Error("Expected an error for an invalid max_lifetime")
+	}
+}
+
+func TestMySQLCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wysci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := generateCertificate(t, 1, pkix.Name{CommonName: "Database CA"}, nil)
+	client := generateCertificate(t, 2, pkix.Name{CommonName: "reports"}, &ca)
+
+	files := map[string][]byte{"ca.pem": ca.certPEM, "client.pem": client.certPEM, "client.key": client.keyPEM}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := DBConfig{
+		Driver:      DriverMySQL,
+		SSLMode:     "verify-ca",
+		SSLRootCert: filepath.Join(dir, "ca.pem"),
+		SSLCert:     filepath.Join(dir, "client.pem"),
+		SSLKey:      filepath.Join(dir, "client.key"),
+	}
+
+	if !strings.Contains(config.ConnectionString(), "tls="+config.mysqlTLS()) || !strings.HasPrefix(config.mysqlTLS(), mysqlTLSPrefix) {
+		t.Errorf("Expected a registered TLS configuration in %s", config.ConnectionString())
+	}
+
+	if err = registerMySQLTLS(config); err != nil {
+		t.Error(err)
+	}
+
+	// Without a root certificate the server is verified against the
+	// system's roots
+	config.SSLRootCert = ""
+	tlsConfig, err := mysqlTLSConfig(config)
+	if err != nil || tlsConfig.InsecureSkipVerify || tlsConfig.RootCAs != nil {
+		t.Errorf("Expected verify-ca without a root certificate to verify the server: %v", err)
+	}
+
+	config.SSLMode = "require"
+	if tlsConfig, err = mysqlTLSConfig(config); err != nil || !tlsConfig.InsecureSkipVerify {
+		t.Errorf("Expected require without a root certificate to skip verification: %v", err)
+	}
+
+	config.SSLRootCert = filepath.Join(dir, "client.key")
+	if err = registerMySQLTLS(config); err == nil {
+		t.Error("Expected an error for a root certificate file without certificates")
+	}
+}
+
+func TestPing(t *testing.T) {
+	if err := testDBs.Ping(context.Background(), 1); err != nil {
+		t.Error(err)
+	}
+
+	defer func(backoff time.Duration) { pingBackoff = backoff }(pingBackoff)
+	pingBackoff = time.Millisecond
+
+	dbs, err := OpenDatabases(DBConfig{Driver: DriverSQLite, DBName: "/nonexistent/wysci/test.db"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbs.Close()
+
+	err = dbs.Ping(context.Background(), 3)
+	if err == nil || !strings.Contains(err.Error(), "not reachable after 3 attempts") {
+		t.Errorf("Expected the database to be unreachable but got %v", err)
+	}
+}
+
+func TestValidateDatabaseSettings(t *testing.T) {
+	config := testConfiguration()
+	config.Database = DBConfig{SSLMode: "always", SSLCert: "client.pem", MaxOpen: -1, ConnectTimeout: "soon"}
+	config.Databases = map[string]DBConfig{
+		"local":  {Driver: DriverSQLite, DBName: "local.db", SSLMode: "require"},
+		"orders": {Driver: DriverMySQL, SSLMode: "allow"},
+		"stock":  {Driver: DriverMySQL, SSLMode: "prefer", SSLCert: "client.pem", SSLKey: "client.key"},
+		"sales":  {Driver: DriverPostgres, SSLMode: "prefer"},
+	}
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected errors but got %v", config.Validate())
+	}
+
+	keys := map[string]bool{}
+	for _, e := range errs {
+		keys[e.Key] = true
+	}
+
+	for _, key := range []string{"database.ssl_mode", "database", "database.max_open", "database.connect_timeout", "databases.local", "databases.orders.ssl_mode", "databases.stock.ssl_mode", "databases.sales.ssl_mode"} {
+		if !keys[key] {
+			t.Errorf("Expected an error for %s in %v", key, errs)
+		}
+	}
+	if len(errs) != 8 {
+		t.Errorf("Expected 8 errors but got %v", errs)
+	}
+}
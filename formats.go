@@ -0,0 +1,270 @@
+package wysci
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OutputFormat describes a response format an endpoint can produce.
+// The MediaType is matched against the Accept header while the Name is
+// matched against the format query parameter.
+type OutputFormat struct {
+	Name        string
+	MediaType   string
+	ContentType string
+	Extension   string
+	Attachment  bool
+	create      func(q Query, e Endpoint, qc QueryConfig) (Formatter, error)
+}
+
+// NewFormatter creates a formatter for the query in this output format.
+// The endpoint and query configurations supply format options such as the
+// sheet name and the break columns.
+func (o OutputFormat) NewFormatter(q Query, e Endpoint, qc QueryConfig) (Formatter, error) {
+	return o.create(q, e, qc)
+}
+
+// ContentDisposition returns the Content-Disposition header for a response
+// from the named endpoint, or the empty string if the format is displayed
+// inline.
+func (o OutputFormat) ContentDisposition(name string) string {
+	if !o.Attachment {
+		return ""
+	}
+
+	return mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("%s.%s", name, o.Extension),
+	})
+}
+
+// The supported output formats.  The first format is the default when the
+// client does not express a preference.
+var outputFormats = []OutputFormat{
+	{
+		Name:        "csv",
+		MediaType:   "text/csv",
+		ContentType: "text/csv; charset=utf-8",
+		Extension:   "csv",
+		Attachment:  true,
+		create: func(q Query, e Endpoint, qc QueryConfig) (Formatter, error) {
+			formatter, err := NewCSVFormatter(q)
+			if err != nil {
+				return nil, err
+			}
+			formatter.BreakColumns = qc.BreakColumns()
+			formatter.BreakStyle = e.BreakStyle
+			return formatter, nil
+		},
+	},
+	{
+		Name:        "tsv",
+		MediaType:   "text/tab-separated-values",
+		ContentType: "text/tab-separated-values; charset=utf-8",
+		Extension:   "tsv",
+		Attachment:  true,
+		create: func(q Query, e Endpoint, qc QueryConfig) (Formatter, error) {
+			formatter, err := NewCSVFormatter(q)
+			if err != nil {
+				return nil, err
+			}
+			formatter.Delimiter = "\t"
+			formatter.BreakColumns = qc.BreakColumns()
+			formatter.BreakStyle = e.BreakStyle
+			return formatter, nil
+		},
+	},
+	{
+		Name:        "json",
+		MediaType:   "application/json",
+		ContentType: "application/json; charset=utf-8",
+		Extension:   "json",
+		create: func(q Query, e Endpoint, qc QueryConfig) (Formatter, error) {
+			return newNestedJSONFormatter(q, qc)
+		},
+	},
+	{
+		Name:        "ndjson",
+		MediaType:   "application/x-ndjson",
+		ContentType: "application/x-ndjson; charset=utf-8",
+		Extension:   "ndjson",
+		create: func(q Query, e Endpoint, qc QueryConfig) (Formatter, error) {
+			formatter, err := newNestedJSONFormatter(q, qc)
+			if err != nil {
+				return nil, err
+			}
+			formatter.LineDelimited = true
+			return formatter, nil
+		},
+	},
+	{
+		Name:        "xlsx",
+		MediaType:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Extension:   "xlsx",
+		Attachment:  true,
+		create: func(q Query, e Endpoint, qc QueryConfig) (Formatter, error) {
+			formatter, err := NewXLSXFormatter(q)
+			if err != nil {
+				return nil, err
+			}
+			if e.Sheet != "" {
+				formatter.SheetName = e.Sheet
+			}
+			return formatter, nil
+		},
+	},
+}
+
+// Creates a JSON formatter nested by the query's break columns
+func newNestedJSONFormatter(q Query, qc QueryConfig) (*JSONFormatter, error) {
+	formatter, err := NewJSONFormatter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	formatter.BreakColumns = qc.BreakColumns()
+	if qc.Children != "" {
+		formatter.ChildKey = qc.Children
+	}
+	return formatter, nil
+}
+
+// LookupFormat returns the output format with the given name.
+func LookupFormat(name string) (OutputFormat, bool) {
+	for _, f := range outputFormats {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+
+	return OutputFormat{}, false
+}
+
+// FormatNames returns the names of every supported output format.
+func FormatNames() []string {
+	names := make([]string, len(outputFormats))
+	for i, f := range outputFormats {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// The formats an endpoint allows, in order of preference.
+func endpointFormats(e Endpoint) []OutputFormat {
+	if len(e.Formats) == 0 {
+		return outputFormats
+	}
+
+	formats := []OutputFormat{}
+	for _, name := range e.Formats {
+		if f, ok := LookupFormat(name); ok {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// The names of the formats an endpoint allows.
+func endpointFormatNames(e Endpoint) []string {
+	formats := endpointFormats(e)
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = f.Name
+	}
+	return names
+}
+
+type mediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// Parse the Accept header into media ranges ordered by quality
+func parseAccept(header string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		ranges = append(ranges, mediaRange{mediaType: mediaType, quality: quality})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+
+	return ranges
+}
+
+func (m mediaRange) matches(f OutputFormat) bool {
+	switch {
+	case m.mediaType == "*/*":
+		return true
+	case strings.HasSuffix(m.mediaType, "/*"):
+		return strings.HasPrefix(f.MediaType, strings.TrimSuffix(m.mediaType, "*"))
+	}
+
+	return m.mediaType == f.MediaType
+}
+
+// Choose the output format for a request.  The format query parameter takes
+// precedence over the Accept header.  If neither is present the first format
+// the endpoint allows is used.
+func negotiateFormat(r *http.Request, e Endpoint) (OutputFormat, bool) {
+	formats := endpointFormats(e)
+	if len(formats) == 0 {
+		return OutputFormat{}, false
+	}
+
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range formats {
+			if strings.EqualFold(f.Name, name) {
+				return f, true
+			}
+		}
+		return OutputFormat{}, false
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formats[0], true
+	}
+
+	ranges := parseAccept(accept)
+	excluded := func(f OutputFormat) bool {
+		for _, m := range ranges {
+			if m.quality <= 0 && m.matches(f) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range ranges {
+		if m.quality <= 0 {
+			continue
+		}
+
+		for _, f := range formats {
+			if m.matches(f) && !excluded(f) {
+				return f, true
+			}
+		}
+	}
+
+	return OutputFormat{}, false
+}
@@ -0,0 +1,105 @@
+package wysci
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormatDefault(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/sales", nil)
+
+	f, ok := negotiateFormat(r, Endpoint{})
+	if !ok {
+		t.Fatal("Expected a default format")
+	}
+
+	if f.Name != "csv" {
+		t.Errorf("Expected csv but got %s", f.Name)
+	}
+
+	f, ok = negotiateFormat(r, Endpoint{Formats: []string{"json", "csv"}})
+	if !ok {
+		t.Fatal("Expected a default format")
+	}
+
+	if f.Name != "json" {
+		t.Errorf("Expected the first allowed format json but got %s", f.Name)
+	}
+}
+
+func TestNegotiateFormatQueryParameter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/sales?format=ndjson", nil)
+	r.Header.Set("Accept", "text/csv")
+
+	f, ok := negotiateFormat(r, Endpoint{})
+	if !ok {
+		t.Fatal("Expected a format")
+	}
+
+	if f.Name != "ndjson" {
+		t.Errorf("Expected ndjson but got %s", f.Name)
+	}
+
+	_, ok = negotiateFormat(r, Endpoint{Formats: []string{"csv"}})
+	if ok {
+		t.Error("Expected ndjson to be rejected when only csv is allowed")
+	}
+}
+
+func TestNegotiateFormatAccept(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/sales", nil)
+	r.Header.Set("Accept", "text/csv;q=0.5, application/json")
+
+	f, ok := negotiateFormat(r, Endpoint{})
+	if !ok {
+		t.Fatal("Expected a format")
+	}
+
+	if f.Name != "json" {
+		t.Errorf("Expected json but got %s", f.Name)
+	}
+
+	r.Header.Set("Accept", "text/*")
+	f, ok = negotiateFormat(r, Endpoint{Formats: []string{"json", "tsv"}})
+	if !ok {
+		t.Fatal("Expected a format")
+	}
+
+	if f.Name != "tsv" {
+		t.Errorf("Expected tsv but got %s", f.Name)
+	}
+
+	r.Header.Set("Accept", "image/png")
+	_, ok = negotiateFormat(r, Endpoint{})
+	if ok {
+		t.Error("Expected image/png to be unacceptable")
+	}
+
+	r.Header.Set("Accept", "text/csv;q=0, */*")
+	f, ok = negotiateFormat(r, Endpoint{Formats: []string{"csv", "json"}})
+	if !ok {
+		t.Fatal("Expected a format")
+	}
+
+	if f.Name != "json" {
+		t.Errorf("Expected json when csv is excluded but got %s", f.Name)
+	}
+
+	r.Header.Set("Accept", "text/*;q=0, */*")
+	f, ok = negotiateFormat(r, Endpoint{Formats: []string{"csv", "tsv", "json"}})
+	if !ok || f.Name != "json" {
+		t.Errorf("Expected json when text formats are excluded but got %s", f.Name)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	csv, _ := LookupFormat("csv")
+	if d := csv.ContentDisposition("sales"); d != "attachment; filename=sales.csv" {
+		t.Errorf("Unexpected disposition: %s", d)
+	}
+
+	json, _ := LookupFormat("json")
+	if d := json.ContentDisposition("sales"); d != "" {
+		t.Errorf("Expected no disposition for json but got %s", d)
+	}
+}
@@ -0,0 +1,263 @@
+package wysci
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The Finisher interface is implemented by formatters that need to write
+// trailing output once the last row has been formatted.  For example, a
+// JSON array has to be closed even when the query returned no rows.
+type Finisher interface {
+	Finish(w io.Writer) (int, error)
+}
+
+// Matches the values that can be written as a JSON number as-is
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// JSONFormatter implements the Formatter interface to format JSON output.
+// Each row is written as an object keyed by the query column names and the
+// rows are wrapped in a JSON array.  NULL values are written as JSON null.
+// Number, boolean, and JSON columns are written as JSON values rather than
+// strings when the database value can be represented that way.
+// Setting LineDelimited writes newline delimited JSON (one object per line)
+// instead of an array.
+//
+// Setting BreakColumns nests the output.  Consecutive rows with the same
+// values in the break columns are written as one parent object holding the
+// break columns and an array, named by ChildKey, of the remaining columns.
+type JSONFormatter struct {
+	LineDelimited bool
+	BreakColumns  []string
+	ChildKey      string
+	query         Query
+	types         []DBType
+	breaks        *breakTracker
+	didPrintStart bool
+	inGroup       bool
+}
+
+// NewJSONFormatter creates a new JSON Formatter.
+// The ChildKey is defaulted to rows.  The query parameter is the executed
+// query whose columns are used as the keys for each object.
+func NewJSONFormatter(q Query) (*JSONFormatter, error) {
+	formatter := &JSONFormatter{}
+	formatter.ChildKey = "rows"
+	formatter.query = q
+	formatter.types = q.Types()
+
+	return formatter, nil
+}
+
+func (j *JSONFormatter) writeValue(col int, v sql.NullString, b *bytes.Buffer) error {
+	if !v.Valid {
+		b.WriteString("null")
+		return nil
+	}
+
+	dbType := DBUnknown
+	if col < len(j.types) {
+		dbType = j.types[col]
+	}
+
+	switch dbType {
+	case DBNumber:
+		if jsonNumber.MatchString(v.String) {
+			b.WriteString(v.String)
+			return nil
+		}
+	case DBBoolean:
+		if parsed, err := strconv.ParseBool(v.String); err == nil {
+			b.WriteString(strconv.FormatBool(parsed))
+			return nil
+		}
+	case DBJSON:
+		if json.Valid([]byte(v.String)) {
+			b.WriteString(v.String)
+			return nil
+		}
+	}
+
+	value, err := json.Marshal(v.String)
+	if err != nil {
+		return err
+	}
+	b.Write(value)
+
+	return nil
+}
+
+// Writes the members of an object for the columns accepted by the filter
+func (j *JSONFormatter) writeMembers(values []sql.NullString, b *bytes.Buffer, include func(int) bool) error {
+	first := true
+	for i, v := range values {
+		if !include(i) {
+			continue
+		}
+
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+
+		name, err := json.Marshal(j.query.columns[i])
+		if err != nil {
+			return err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+
+		err = j.writeValue(i, v, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *JSONFormatter) writeObject(values []sql.NullString, b *bytes.Buffer) error {
+	b.WriteByte('{')
+	err := j.writeMembers(values, b, func(int) bool { return true })
+	if err != nil {
+		return err
+	}
+	b.WriteByte('}')
+
+	return nil
+}
+
+// Closes the child array and the parent object of the current group
+func (j *JSONFormatter) closeGroup(b *bytes.Buffer) {
+	if !j.inGroup {
+		return
+	}
+
+	b.WriteString("]}")
+	if j.LineDelimited {
+		b.WriteByte('\n')
+	}
+	j.inGroup = false
+}
+
+// Writes the row as a child of the current group, starting a new parent
+// object when the break columns change
+func (j *JSONFormatter) writeGrouped(values []sql.NullString, b *bytes.Buffer) error {
+	if j.breaks == nil {
+		breaks, err := newBreakTracker(j.query, j.BreakColumns)
+		if err != nil {
+			return err
+		}
+		j.breaks = breaks
+	}
+
+	if !j.breaks.next(values) {
+		b.WriteByte(',')
+	} else {
+		j.closeGroup(b)
+		j.startElement(b)
+
+		b.WriteByte('{')
+		err := j.writeMembers(values, b, j.breaks.isBreak)
+		if err != nil {
+			return err
+		}
+
+		childKey, err := json.Marshal(j.ChildKey)
+		if err != nil {
+			return err
+		}
+		b.WriteByte(',')
+		b.Write(childKey)
+		b.WriteString(":[")
+		j.inGroup = true
+	}
+
+	b.WriteByte('{')
+	err := j.writeMembers(values, b, func(col int) bool { return !j.breaks.isBreak(col) })
+	if err != nil {
+		return err
+	}
+	b.WriteByte('}')
+
+	return nil
+}
+
+// Writes the array punctuation that precedes a top level element
+func (j *JSONFormatter) startElement(b *bytes.Buffer) {
+	if !j.LineDelimited {
+		if j.didPrintStart {
+			b.WriteByte(',')
+		} else {
+			b.WriteByte('[')
+		}
+	}
+	j.didPrintStart = true
+}
+
+// Format formats a row as a JSON object.
+// It implements the Formatter interface for the JSONFormatter type.
+func (j *JSONFormatter) Format(values []sql.NullString, w io.Writer) (int, error) {
+	var err error
+	b := new(bytes.Buffer)
+
+	if len(j.BreakColumns) > 0 {
+		err = j.writeGrouped(values, b)
+	} else {
+		j.startElement(b)
+		err = j.writeObject(values, b)
+		if j.LineDelimited {
+			b.WriteByte('\n')
+		}
+	}
+
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to encode response row: %v", err)
+		return 0, err
+	}
+
+	n, err := w.Write(b.Bytes())
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to write buffer: %v", err)
+		return n, err
+	}
+
+	return n, nil
+}
+
+// Finish closes the last group and the JSON array.  Line delimited output
+// has no array to close.
+// It implements the Finisher interface for the JSONFormatter type.
+func (j *JSONFormatter) Finish(w io.Writer) (int, error) {
+	b := new(bytes.Buffer)
+	j.closeGroup(b)
+
+	if !j.LineDelimited {
+		if j.didPrintStart {
+			b.WriteByte(']')
+		} else {
+			b.WriteString("[]")
+			j.didPrintStart = true
+		}
+	}
+
+	n, err := w.Write(b.Bytes())
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to write buffer: %v", err)
+		return n, err
+	}
+
+	return n, nil
+}
+
+// ColumnCount returns the columns in the JSON formatter.
+// It implements the ColumnCounter interface for the JSONFormatter type.
+func (j *JSONFormatter) ColumnCount() int {
+	return len(j.query.columns)
+}
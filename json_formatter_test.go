@@ -0,0 +1,207 @@
+package wysci
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONFormat(t *testing.T) {
+	j := &JSONFormatter{
+		query: Query{
+			columns: []string{"foo", "bar"},
+		},
+	}
+
+	b := new(bytes.Buffer)
+	_, err := j.Format([]sql.NullString{{String: "one", Valid: true}, {}}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = j.Format([]sql.NullString{{String: "two", Valid: true}, {String: "", Valid: true}}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = j.Finish(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"foo":"one","bar":null},{"foo":"two","bar":""}]`
+	if b.String() != expected {
+		t.Errorf("Expected %s but got %s", expected, b.String())
+	}
+}
+
+func TestJSONFormatNoRows(t *testing.T) {
+	j := &JSONFormatter{}
+
+	b := new(bytes.Buffer)
+	_, err := j.Finish(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.String() != "[]" {
+		t.Errorf("Expected empty array but got %s", b.String())
+	}
+}
+
+func TestProcessorWithJSONFormatter(t *testing.T) {
+	query, err := ExecuteQuery(testConn, "select id, name from test_simple where id in (2, 4) order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	formatter, err := NewJSONFormatter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := new(bytes.Buffer)
+	qp := QueryProcessor{RowFormatter: formatter}
+	_, err = qp.Process(query, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []map[string]interface{}
+	err = json.Unmarshal(output.Bytes(), &rows)
+	if err != nil {
+		t.Fatalf("Failed to parse output %s: %v", output.String(), err)
+	}
+
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows but got %d", len(rows))
+	}
+
+	if rows[0]["name"] != nil {
+		t.Errorf("Expected NULL name to be null but got %v", rows[0]["name"])
+	}
+
+	if rows[0]["id"] != 2.0 {
+		t.Errorf("Expected numeric id 2 but got %v", rows[0]["id"])
+	}
+
+	if rows[1]["name"] != "embedded,comma" {
+		t.Errorf("Expected 'embedded,comma' but got %v", rows[1]["name"])
+	}
+}
+
+func TestJSONFormatTypedValues(t *testing.T) {
+	j := &JSONFormatter{
+		query: Query{
+			columns: []string{"n", "money", "flag", "doc", "text"},
+		},
+		types: []DBType{DBNumber, DBNumber, DBBoolean, DBJSON, DBText},
+	}
+
+	b := new(bytes.Buffer)
+	values := []sql.NullString{
+		{String: "-1.5e3", Valid: true},
+		{String: "$1.00", Valid: true},
+		{String: "t", Valid: true},
+		{String: `{"a": [1, 2]}`, Valid: true},
+		{String: "42", Valid: true},
+	}
+
+	_, err := j.Format(values, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"n":-1.5e3,"money":"$1.00","flag":true,"doc":{"a": [1, 2]},"text":"42"}`
+	if b.String() != expected {
+		t.Errorf("Expected %s but got %s", expected, b.String())
+	}
+}
+
+func formatAll(t *testing.T, f Formatter, rows [][]sql.NullString) string {
+	b := new(bytes.Buffer)
+	for _, row := range rows {
+		_, err := f.Format(row, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if finisher, ok := f.(Finisher); ok {
+		_, err := finisher.Finish(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.String()
+}
+
+func groupedRows() [][]sql.NullString {
+	row := func(values ...string) []sql.NullString {
+		result := make([]sql.NullString, len(values))
+		for i, v := range values {
+			result[i] = sql.NullString{String: v, Valid: true}
+		}
+		return result
+	}
+
+	return [][]sql.NullString{
+		row("1", "Acme", "Main St", "1.50"),
+		row("1", "Acme", "Side St", "2.25"),
+		row("2", "Bolt", "High St", "3"),
+	}
+}
+
+func TestJSONFormatGrouped(t *testing.T) {
+	j := &JSONFormatter{
+		BreakColumns: []string{"id", "name"},
+		ChildKey:     "addresses",
+		query: Query{
+			columns: []string{"id", "name", "street", "amount"},
+		},
+		types: []DBType{DBNumber, DBText, DBText, DBNumber},
+	}
+
+	expected := `[{"id":1,"name":"Acme","addresses":[{"street":"Main St","amount":1.50},{"street":"Side St","amount":2.25}]},` +
+		`{"id":2,"name":"Bolt","addresses":[{"street":"High St","amount":3}]}]`
+
+	actual := formatAll(t, j, groupedRows())
+	if actual != expected {
+		t.Errorf("Expected %s but got %s", expected, actual)
+	}
+}
+
+func TestJSONFormatGroupedLineDelimited(t *testing.T) {
+	j := &JSONFormatter{
+		LineDelimited: true,
+		BreakColumns:  []string{"id"},
+		ChildKey:      "rows",
+		query: Query{
+			columns: []string{"id", "name", "street", "amount"},
+		},
+	}
+
+	expected := `{"id":"1","rows":[{"name":"Acme","street":"Main St","amount":"1.50"},{"name":"Acme","street":"Side St","amount":"2.25"}]}` + "\n" +
+		`{"id":"2","rows":[{"name":"Bolt","street":"High St","amount":"3"}]}` + "\n"
+
+	actual := formatAll(t, j, groupedRows())
+	if actual != expected {
+		t.Errorf("Expected %s but got %s", expected, actual)
+	}
+}
+
+func TestJSONFormatUnknownBreakColumn(t *testing.T) {
+	j := &JSONFormatter{
+		BreakColumns: []string{"cust"},
+		query: Query{
+			columns: []string{"id"},
+		},
+	}
+
+	_, err := j.Format([]sql.NullString{{String: "1", Valid: true}}, new(bytes.Buffer))
+	if err == nil {
+		t.Error("Expected an error for an unknown break column")
+	}
+}
@@ -0,0 +1,394 @@
+package wysci
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A key that can verify token signatures
+type jwtKey struct {
+	id  string
+	key interface{}
+}
+
+// A JSON web key from a JWKS file
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// Decodes a base64url value with or without padding
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// Converts a JSON web key to an RSA or ECDSA public key or an HMAC secret
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "oct":
+		return decodeSegment(k.K)
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// Reads the signature verification keys of a JWKS file
+func readJWKS(path string) ([]jwtKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	keys := []jwtKey{}
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %v", path, i, err)
+		}
+		keys = append(keys, jwtKey{id: k.Kid, key: key})
+	}
+
+	return keys, nil
+}
+
+// Reads the public keys or certificates of a PEM file
+func readPEMKeys(path string) ([]jwtKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []jwtKey{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys", path)
+	}
+
+	return keys, nil
+}
+
+type jwtAuthenticator struct {
+	issuer     string
+	audience   string
+	userClaim  string
+	rolesClaim string
+	keys       []jwtKey
+}
+
+func newJWTAuthenticator(config JWTConfig) (*jwtAuthenticator, error) {
+	auth := &jwtAuthenticator{
+		issuer:     config.Issuer,
+		audience:   config.Audience,
+		userClaim:  config.UserClaim,
+		rolesClaim: config.RolesClaim,
+	}
+
+	if auth.userClaim == "" {
+		auth.userClaim = "sub"
+	}
+
+	if config.JWKSFile != "" {
+		keys, err := readJWKS(config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read JWKS: %v", err)
+		}
+		auth.keys = append(auth.keys, keys...)
+	}
+
+	if config.PEMFile != "" {
+		keys, err := readPEMKeys(config.PEMFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read PEM keys: %v", err)
+		}
+		auth.keys = append(auth.keys, keys...)
+	}
+
+	if len(auth.keys) == 0 {
+		return nil, fmt.Errorf("JWT authentication requires a jwks_file or pem_file")
+	}
+
+	return auth, nil
+}
+
+// Verifies the signature of the signed content with a key suitable for the
+// algorithm.  The key's type must match the algorithm so that, for example,
+// an RSA public key is never used as an HMAC secret.
+func verifySignature(alg string, key interface{}, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	case "HS256":
+		k, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	return false
+}
+
+// Returns the string values of a claim that is a string or an array.  A
+// string may hold several values separated by commas or spaces.
+func claimStrings(claim interface{}) []string {
+	values := []string{}
+
+	switch v := claim.(type) {
+	case string:
+		values = append(values, strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return values
+}
+
+// Returns true if the aud claim names the audience.  The claim is a single
+// audience or an array of them, and unlike the roles claim a string is
+// never split.
+func hasAudience(claim interface{}, audience string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, e := range v {
+			if e == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the time of a numeric date claim, which is in seconds since the epoch
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// Returns a claim by name, where a dotted name such as realm_access.roles
+// refers to a claim nested in an object
+func claimValue(claims map[string]interface{}, name string) interface{} {
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+// Parses and validates a compact serialized token, returning its claims
+func (a *jwtAuthenticator) validate(token string) (map[string]interface{}, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerJSON, err := decodeSegment(segments[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	signature, err := decodeSegment(segments[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+
+	signed := []byte(segments[0] + "." + segments[1])
+	verified := false
+	for _, k := range a.keys {
+		if header.Kid != "" && k.id != "" && header.Kid != k.id {
+			continue
+		}
+		if verifySignature(header.Alg, k.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid %s signature", header.Alg)
+	}
+
+	payload, err := decodeSegment(segments[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+
+	claims := map[string]interface{}{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+
+	now := time.Now()
+	exp, ok := claimTime(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if !now.Before(exp) {
+		return nil, fmt.Errorf("token expired at %s", exp.Format(time.RFC3339))
+	}
+
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Before(nbf) {
+		return nil, fmt.Errorf("token is not valid before %s", nbf.Format(time.RFC3339))
+	}
+
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+
+	return claims, nil
+}
+
+// Authenticate implements the Authenticator interface for bearer tokens
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, nil
+	}
+
+	claims, err := a.validate(strings.TrimSpace(authorization[7:]))
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := claimValue(claims, a.userClaim).(string)
+	if user == "" {
+		return nil, fmt.Errorf("token has no %s claim", a.userClaim)
+	}
+
+	p := &Principal{User: user, Method: "jwt", Roles: []string{}, Claims: claims}
+	if a.rolesClaim != "" {
+		p.Roles = claimStrings(claimValue(claims, a.rolesClaim))
+	}
+
+	return p, nil
+}
@@ -0,0 +1,207 @@
+package wysci
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testHMACSecret  = []byte("a shared secret for testing tokens")
+	base64URL       = base64.RawURLEncoding.EncodeToString
+	testTokenIssuer = "https://id.example.com"
+)
+
+// Signs a token with the test key for the algorithm
+func signToken(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64URL(header) + "." + base64URL(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, e := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+		err = e
+	case "HS256":
+		mac := hmac.New(sha256.New, testHMACSecret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64URL(signature)
+}
+
+// Writes a temporary file, returning its name
+func writeTempFile(t *testing.T, pattern string, data []byte) string {
+	file, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func testJWKS(t *testing.T) string {
+	e := []byte{1, 0, 1}
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": base64URL(testRSAKey.N.Bytes()), "e": base64URL(e)},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": base64URL(testECKey.X.Bytes()), "y": base64URL(testECKey.Y.Bytes())},
+			{"kty": "oct", "kid": "hmac", "k": base64URL(testHMACSecret)},
+		},
+	}
+
+	data, _ := json.Marshal(jwks)
+	return writeTempFile(t, "wysci-jwks", data)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":    "jsmith",
+		"iss":    testTokenIssuer,
+		"aud":    []string{"wysci", "other"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"sales", "finance"},
+		"tenant": "acme",
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	jwks := testJWKS(t)
+	defer os.Remove(jwks)
+
+	auth, err := newJWTAuthenticator(JWTConfig{
+		JWKSFile:   jwks,
+		Issuer:     testTokenIssuer,
+		Audience:   "wysci",
+		RolesClaim: "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []string{"RS256", "ES256", "HS256"} {
+		r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+		r.Header.Set("Authorization", "Bearer "+signToken(t, alg, "", validClaims()))
+
+		p, err := auth.Authenticate(r)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			continue
+		}
+		if p.User != "jsmith" || !p.HasRole("finance") || p.Claims["tenant"] != "acme" {
+			t.Errorf("%s: unexpected principal %v", alg, p)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+	if p, err := auth.Authenticate(r); p != nil || err != nil {
+		t.Errorf("Expected no principal without a token: %v %v", p, err)
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	jwks := testJWKS(t)
+	defer os.Remove(jwks)
+
+	auth, err := newJWTAuthenticator(JWTConfig{JWKSFile: jwks, Issuer: testTokenIssuer, Audience: "wysci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+
+	issuer := validClaims()
+	issuer["iss"] = "https://elsewhere.example.com"
+
+	audience := validClaims()
+	audience["aud"] = "other"
+
+	audienceList := validClaims()
+	audienceList["aud"] = "other wysci"
+
+	tampered := signToken(t, "RS256", "", validClaims())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	tokens := map[string]string{
+		"expired":   signToken(t, "RS256", "", expired),
+		"no expiry": signToken(t, "RS256", "", noExpiry),
+		"issuer":    signToken(t, "RS256", "", issuer),
+		"audience":  signToken(t, "ES256", "", audience),
+		"aud list":  signToken(t, "ES256", "", audienceList),
+		"wrong kid": signToken(t, "RS256", "ec", validClaims()),
+		"tampered":  tampered,
+		"alg none":  base64URL([]byte(`{"alg":"none"}`)) + "." + base64URL([]byte(`{"sub":"x"}`)) + ".",
+		"malformed": "not-a-token",
+	}
+
+	for name, token := range tokens {
+		r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if _, err := auth.Authenticate(r); err == nil {
+			t.Errorf("Expected the %s token to be rejected", name)
+		}
+	}
+}
+
+func TestJWTPEMKey(t *testing.T) {
+	der, err := x509.MarshalPKIXPublicKey(&testRSAKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTempFile(t, "wysci-pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	defer os.Remove(path)
+
+	auth, err := newJWTAuthenticator(JWTConfig{PEMFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+	r.Header.Set("Authorization", "Bearer "+signToken(t, "RS256", "", validClaims()))
+	if p, err := auth.Authenticate(r); err != nil || p.User != "jsmith" {
+		t.Errorf("Expected jsmith: %v %v", p, err)
+	}
+
+	// The algorithm must match the type of the key
+	r.Header.Set("Authorization", "Bearer "+signToken(t, "HS256", "", validClaims()))
+	if _, err := auth.Authenticate(r); err == nil {
+		t.Error("Expected an HS256 token to be rejected by an RSA key")
+	}
+}
@@ -51,7 +51,10 @@ const (
 		drop table if exists test_simple;`
 )
 
-var testConn *sql.DB
+var (
+	testConn *sql.DB
+	testDBs  Databases
+)
 
 func setup(conn *sql.DB) error {
 	tables := []string{
@@ -105,6 +108,8 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	testDBs = Databases{DefaultDatabase: {DB: testConn, Driver: DriverSQLite}}
+
 	err = setup(testConn)
 	if err != nil {
 		log.Println(err)
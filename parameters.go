@@ -0,0 +1,380 @@
+package wysci
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParameterError describes an endpoint parameter that was missing or could
+// not be converted to its configured type.
+type ParameterError struct {
+	Name    string
+	Type    string
+	Message string
+}
+
+// Error implements the error interface
+func (p ParameterError) Error() string {
+	return fmt.Sprintf("parameter %s (%s): %s", p.Name, p.Type, p.Message)
+}
+
+// ParameterErrors holds every invalid parameter of a request.
+type ParameterErrors []ParameterError
+
+// Error implements the error interface
+func (p ParameterErrors) Error() string {
+	messages := make([]string, len(p))
+	for i, e := range p {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// DefaultValue returns the configured default as it would appear in a
+// request, and false if there is no default.
+func (p Parameter) DefaultValue() (string, bool) {
+	switch v := p.Default.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case time.Time:
+		return p.formatTime(v), true
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, e := range v {
+			if t, ok := e.(time.Time); ok {
+				elements[i] = p.formatTime(t)
+			} else {
+				elements[i] = fmt.Sprint(e)
+			}
+		}
+		return strings.Join(elements, ","), true
+	}
+
+	return fmt.Sprint(p.Default), true
+}
+
+// Formats a TOML date or date-time default in the layout the parameter
+// parses, so the default converts like a request value
+func (p Parameter) formatTime(t time.Time) string {
+	switch {
+	case p.Layout != "":
+		return t.Format(p.Layout)
+	case p.Type == "date" || p.Type == "list" && p.Items == "date":
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// TypeName describes the parameter's type, including the item type of a list.
+func (p Parameter) TypeName() string {
+	if p.Type == "list" {
+		return fmt.Sprintf("list of %s", p.Items)
+	}
+	return p.Type
+}
+
+// Matches an exact decimal number such as -12.50 or 1e3
+var decimalPattern = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// The layouts tried for a timestamp parameter without a configured layout
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// Parses a date or timestamp with the configured layout or the defaults
+func parseTimeParameter(p Parameter, raw string, defaults []string) (time.Time, error) {
+	layouts := defaults
+	if p.Layout != "" {
+		layouts = []string{p.Layout}
+	}
+
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, raw)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("expected a %s like %s but got %q", p.Type, layouts[0], raw)
+}
+
+// Converts a raw request value into the parameter's type
+func convertParameter(p Parameter, raw string) (interface{}, error) {
+	switch p.Type {
+	case "number":
+		val, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a whole number but got %q", raw)
+		}
+		return val, nil
+	case "string":
+		return raw, nil
+	case "decimal":
+		trimmed := strings.TrimSpace(raw)
+		if !decimalPattern.MatchString(trimmed) {
+			return nil, fmt.Errorf("expected a decimal number but got %q", raw)
+		}
+		// Passed as text so the database converts it without rounding
+		return trimmed, nil
+	case "boolean":
+		val, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("expected true or false but got %q", raw)
+		}
+		return val, nil
+	case "date":
+		return parseTimeParameter(p, raw, []string{"2006-01-02"})
+	case "timestamp":
+		return parseTimeParameter(p, raw, timestampLayouts)
+	case "enum":
+		for _, v := range p.Values {
+			if raw == v {
+				return raw, nil
+			}
+		}
+		return nil, fmt.Errorf("expected one of %s but got %q", strings.Join(p.Values, ", "), raw)
+	}
+
+	return nil, fmt.Errorf("unsupported parameter type")
+}
+
+// A list parameter bound as a Postgres array literal, which lets a query
+// use it as in "where id = any($1)".  The elements are always quoted, the
+// database converts them to the array's element type.
+type arrayParameter []string
+
+// Value implements the driver.Valuer interface
+func (a arrayParameter) Value() (driver.Value, error) {
+	b := new(strings.Builder)
+	b.WriteByte('{')
+	for i, e := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteByte('"')
+		for _, r := range e {
+			if r == '"' || r == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String(), nil
+}
+
+// Returns the array element text of a converted value
+func arrayElement(itemType string, val interface{}) string {
+	switch v := val.(type) {
+	case time.Time:
+		if itemType == "date" {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339Nano)
+	case string:
+		return v
+	}
+
+	return fmt.Sprint(val)
+}
+
+// Converts the raw values of a list parameter.  Each raw value may hold
+// several comma separated elements, so a list can be passed either as
+// ids=1,2,3 or as ids=1&ids=2&ids=3.
+func convertList(p Parameter, raws []string) (interface{}, error) {
+	if p.Items == "list" || p.Items == "" {
+		return nil, fmt.Errorf("unsupported list item type %q", p.Items)
+	}
+
+	item := p
+	item.Type = p.Items
+
+	list := arrayParameter{}
+	for _, raw := range raws {
+		for _, element := range strings.Split(raw, ",") {
+			element = strings.TrimSpace(element)
+			if element == "" {
+				continue
+			}
+
+			val, err := convertParameter(item, element)
+			if err != nil {
+				return nil, fmt.Errorf("list item: %v", err)
+			}
+			list = append(list, arrayElement(p.Items, val))
+		}
+	}
+
+	return list, nil
+}
+
+// SQLite has no date types and compares the text it stores, so date and
+// timestamp values are bound as text in the parameter's layout, or as
+// SQLite's own date functions write them.  Timestamps without a layout are
+// written in UTC like SQLite's current_timestamp.
+func sqliteTimes(config Endpoint, parameters []interface{}) {
+	for _, p := range config.Parameters {
+		if p.Ordinal < 1 || p.Ordinal > len(parameters) {
+			continue
+		}
+
+		t, ok := parameters[p.Ordinal-1].(time.Time)
+		switch {
+		case !ok:
+		case p.Layout != "":
+			parameters[p.Ordinal-1] = t.Format(p.Layout)
+		case p.Type == "date":
+			parameters[p.Ordinal-1] = t.Format("2006-01-02")
+		default:
+			parameters[p.Ordinal-1] = t.UTC().Format("2006-01-02 15:04:05.999999999")
+		}
+	}
+}
+
+// FromPrincipal returns true if the parameter's value comes from the
+// authenticated principal instead of the request.
+func (p Parameter) FromPrincipal() bool {
+	return strings.HasPrefix(p.Source, "principal.")
+}
+
+// Returns the text of a claim value
+func claimText(claim interface{}) string {
+	switch v := claim.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(claim)
+}
+
+// Returns the raw values of a parameter taken from the principal.  The
+// source is principal.user, principal.roles, or principal.claim.<name>,
+// where a dotted name refers to a nested claim.
+func principalValues(p *Principal, source string) ([]string, error) {
+	if p == nil {
+		return nil, fmt.Errorf("%s requires an authenticated request", source)
+	}
+
+	switch {
+	case source == "principal.user":
+		return []string{p.User}, nil
+	case source == "principal.roles":
+		return p.Roles, nil
+	case strings.HasPrefix(source, "principal.claim."):
+		claim := claimValue(p.Claims, strings.TrimPrefix(source, "principal.claim."))
+		switch v := claim.(type) {
+		case nil:
+			return nil, fmt.Errorf("%s is not in the principal's claims", source)
+		case []interface{}:
+			raws := make([]string, len(v))
+			for i, e := range v {
+				raws[i] = claimText(e)
+			}
+			return raws, nil
+		}
+		return []string{claimText(claim)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported parameter source %s", source)
+}
+
+// Converts the request values to the query parameters ordered by ordinal.
+// Missing values are replaced by the parameter's default.  An optional
+// parameter with no value and no default is passed as NULL.  Every missing
+// or invalid parameter is reported in the returned ParameterErrors.
+//
+// A parameter with a principal source always takes its value from the
+// principal, never from the request, so a caller cannot override it.  If
+// the principal does not have the value the parameter is reported missing.
+func extractParameters(config Endpoint, values url.Values, principal *Principal) ([]interface{}, error) {
+	count := 0
+	for _, pdesc := range config.Parameters {
+		if pdesc.Ordinal > count {
+			count = pdesc.Ordinal
+		}
+	}
+
+	names := make([]string, 0, len(config.Parameters))
+	for pname := range config.Parameters {
+		names = append(names, pname)
+	}
+	sort.Strings(names)
+
+	parameters := make([]interface{}, count)
+	errs := ParameterErrors{}
+	for _, pname := range names {
+		pdesc := config.Parameters[pname]
+		if pdesc.Ordinal < 1 {
+			errs = append(errs, ParameterError{Name: pname, Type: pdesc.TypeName(), Message: "parameter has no ordinal"})
+			continue
+		}
+
+		requestValues := values[pname]
+		if pdesc.FromPrincipal() {
+			var err error
+			requestValues, err = principalValues(principal, pdesc.Source)
+			if err != nil {
+				errs = append(errs, ParameterError{Name: pname, Type: pdesc.TypeName(), Message: err.Error()})
+				continue
+			}
+		}
+
+		raws := []string{}
+		for _, raw := range requestValues {
+			if raw != "" {
+				raws = append(raws, raw)
+			}
+		}
+
+		if len(raws) == 0 && pdesc.FromPrincipal() {
+			errs = append(errs, ParameterError{Name: pname, Type: pdesc.TypeName(), Message: fmt.Sprintf("%s is empty", pdesc.Source)})
+			continue
+		}
+
+		if len(raws) == 0 {
+			def, ok := pdesc.DefaultValue()
+			switch {
+			case ok:
+				raws = []string{def}
+			case pdesc.Required:
+				errs = append(errs, ParameterError{Name: pname, Type: pdesc.TypeName(), Message: "required parameter is missing"})
+				continue
+			default:
+				continue
+			}
+		}
+
+		var val interface{}
+		var err error
+		if pdesc.Type == "list" {
+			val, err = convertList(pdesc, raws)
+		} else {
+			val, err = convertParameter(pdesc, raws[0])
+		}
+		if err != nil {
+			errs = append(errs, ParameterError{Name: pname, Type: pdesc.TypeName(), Message: err.Error()})
+			continue
+		}
+		parameters[pdesc.Ordinal-1] = val
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return parameters, nil
+}
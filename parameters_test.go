@@ -0,0 +1,274 @@
+package wysci
+
+import (
+	"database/sql/driver"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestExtractParameters(t *testing.T) {
+	config := Endpoint{
+		Parameters: map[string]Parameter{
+			"id":    {Type: "number", Ordinal: 2, Required: true},
+			"name":  {Type: "string", Ordinal: 1},
+			"limit": {Type: "number", Ordinal: 3, Default: int64(10)},
+		},
+	}
+
+	values, err := url.ParseQuery("id=42&name=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := extractParameters(config, values, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(params) != 3 {
+		t.Fatalf("Expected 3 parameters but got %d", len(params))
+	}
+
+	if params[0] != "foo" || params[1] != int64(42) || params[2] != int64(10) {
+		t.Errorf("Unexpected parameters %v", params)
+	}
+}
+
+func TestExtractParametersOptional(t *testing.T) {
+	config := Endpoint{
+		Parameters: map[string]Parameter{
+			"name": {Type: "string", Ordinal: 1},
+		},
+	}
+
+	params, err := extractParameters(config, url.Values{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params[0] != nil {
+		t.Errorf("Expected a missing optional parameter to be nil but got %v", params[0])
+	}
+}
+
+func TestExtractParametersTOMLDateDefaults(t *testing.T) {
+	var config Endpoint
+	_, err := toml.Decode(`
+[parameters.since]
+type = "date"
+ordinal = 1
+default = 2019-01-01
+
+[parameters.until]
+type = "timestamp"
+ordinal = 2
+default = 2019-01-04T10:30:00Z
+
+[parameters.month]
+type = "date"
+layout = "2006-01"
+ordinal = 3
+default = 2019-02-01
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := extractParameters(config, url.Values{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2019, 1, 4, 10, 30, 0, 0, time.UTC),
+		time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i := range expected {
+		if !params[i].(time.Time).Equal(expected[i].(time.Time)) {
+			t.Errorf("Expected %v but got %v", expected[i], params[i])
+		}
+	}
+}
+
+func TestExtractParametersErrors(t *testing.T) {
+	config := Endpoint{
+		Parameters: map[string]Parameter{
+			"id":    {Type: "number", Ordinal: 1, Required: true},
+			"count": {Type: "number", Ordinal: 2},
+		},
+	}
+
+	values, err := url.ParseQuery("count=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = extractParameters(config, values, nil)
+	errs, ok := err.(ParameterErrors)
+	if !ok {
+		t.Fatalf("Expected ParameterErrors but got %v", err)
+	}
+
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %d", len(errs))
+	}
+
+	if errs[0].Name != "count" || errs[0].Type != "number" {
+		t.Errorf("Expected the first error for count but got %v", errs[0])
+	}
+
+	if errs[1].Name != "id" || errs[1].Message != "required parameter is missing" {
+		t.Errorf("Expected a missing id error but got %v", errs[1])
+	}
+}
+
+func TestConvertParameterTypes(t *testing.T) {
+	tests := []struct {
+		param    Parameter
+		raw      string
+		expected interface{}
+	}{
+		{Parameter{Type: "decimal"}, "12.50", "12.50"},
+		{Parameter{Type: "boolean"}, "true", true},
+		{Parameter{Type: "boolean"}, "0", false},
+		{Parameter{Type: "date"}, "2019-01-02", time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Parameter{Type: "date", Layout: "01/02/2006"}, "01/02/2019", time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Parameter{Type: "timestamp"}, "2019-01-02T03:04:05Z", time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Parameter{Type: "timestamp"}, "2019-01-02 03:04:05", time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Parameter{Type: "enum", Values: []string{"open", "closed"}}, "closed", "closed"},
+	}
+
+	for _, test := range tests {
+		actual, err := convertParameter(test.param, test.raw)
+		if err != nil {
+			t.Errorf("Failed to convert %s %q: %v", test.param.Type, test.raw, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected %s %q to be %v but got %v", test.param.Type, test.raw, test.expected, actual)
+		}
+	}
+}
+
+func TestConvertParameterTypeErrors(t *testing.T) {
+	tests := []struct {
+		param Parameter
+		raw   string
+	}{
+		{Parameter{Type: "number"}, "1.5"},
+		{Parameter{Type: "decimal"}, "1,000"},
+		{Parameter{Type: "boolean"}, "maybe"},
+		{Parameter{Type: "date"}, "01/02/2019"},
+		{Parameter{Type: "timestamp"}, "yesterday"},
+		{Parameter{Type: "enum", Values: []string{"open", "closed"}}, "pending"},
+		{Parameter{Type: "money"}, "1"},
+	}
+
+	for _, test := range tests {
+		_, err := convertParameter(test.param, test.raw)
+		if err == nil {
+			t.Errorf("Expected %s %q to fail", test.param.Type, test.raw)
+		}
+	}
+}
+
+func TestExtractListParameter(t *testing.T) {
+	config := Endpoint{
+		Parameters: map[string]Parameter{
+			"ids":   {Type: "list", Items: "number", Ordinal: 1},
+			"names": {Type: "list", Items: "string", Ordinal: 2},
+		},
+	}
+
+	values, err := url.ParseQuery("ids=1,2&ids=3&names=a%22b&names=c%5Cd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := extractParameters(config, values, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := params[0].(driver.Valuer).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids != `{"1","2","3"}` {
+		t.Errorf("Unexpected array literal %v", ids)
+	}
+
+	names, err := params[1].(driver.Valuer).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names != `{"a\"b","c\\d"}` {
+		t.Errorf("Unexpected array literal %v", names)
+	}
+
+	values, err = url.ParseQuery("ids=1,x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = extractParameters(config, values, nil)
+	errs, ok := err.(ParameterErrors)
+	if !ok || len(errs) != 1 || errs[0].Type != "list of number" {
+		t.Errorf("Expected an error for the list item but got %v", err)
+	}
+}
+
+func TestExtractParametersFromPrincipal(t *testing.T) {
+	config := Endpoint{
+		Parameters: map[string]Parameter{
+			"user":   {Type: "string", Ordinal: 1, Source: "principal.user"},
+			"tenant": {Type: "number", Ordinal: 2, Source: "principal.claim.org.tenant_id"},
+			"roles":  {Type: "list", Items: "string", Ordinal: 3, Source: "principal.roles"},
+		},
+	}
+
+	p := &Principal{
+		User:   "jsmith",
+		Roles:  []string{"sales", "finance"},
+		Claims: map[string]interface{}{"org": map[string]interface{}{"tenant_id": float64(42)}},
+	}
+
+	// The caller cannot override a value from the principal
+	values, err := url.ParseQuery("user=admin&tenant=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := extractParameters(config, values, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params[0] != "jsmith" || params[1] != int64(42) {
+		t.Errorf("Unexpected parameters %v", params)
+	}
+
+	if !reflect.DeepEqual(params[2], arrayParameter{"sales", "finance"}) {
+		t.Errorf("Expected the roles but got %v", params[2])
+	}
+
+	_, err = extractParameters(config, values, nil)
+	errs, ok := err.(ParameterErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("Expected 3 errors without a principal but got %v", err)
+	}
+
+	p.Claims = map[string]interface{}{}
+	p.Roles = nil
+	_, err = extractParameters(config, values, p)
+	errs, ok = err.(ParameterErrors)
+	if !ok || len(errs) != 2 {
+		t.Errorf("Expected errors for the missing claim and roles but got %v", err)
+	}
+}
@@ -13,6 +13,12 @@ import (
 
 var safeEOL = []byte("\r\n")
 
+// The layouts of date and timestamp values in CSV output
+const (
+	csvDateLayout      = "01/02/2006"
+	csvTimestampLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+)
+
 // The Formatter interface is implemented by types that format responses.
 // The Format function expects a slice of nullable strings that have been
 // populated by a previous call to Scan.  It will then write those values to
@@ -21,13 +27,31 @@ type Formatter interface {
 	Format(values []sql.NullString, w io.Writer) (int, error)
 }
 
+const (
+	// BreakBlank separates groups of rows with a blank line
+	BreakBlank = "blank"
+	// BreakSubtotal follows each group of rows with a subtotal line
+	BreakSubtotal = "subtotal"
+)
+
 // CSVFormatter implements the Formatter interface to format CSV output.
 // It outputs delimited format database columns.  The delimiter and the
 // value for NULL strings can be customized by setting the respective
 // fields.
+//
+// Setting BreakColumns and a BreakStyle separates groups of consecutive
+// rows sharing the same break column values.  The BreakBlank style writes a
+// blank line between groups while BreakSubtotal writes a line after each
+// group with the sum of its numeric columns.
 type CSVFormatter struct {
 	Delimiter, NullString string
+	BreakColumns          []string
+	BreakStyle            string
 	query                 Query
+	types                 []DBType
+	breaks                *breakTracker
+	totals                *subtotals
+	lastRow               []sql.NullString
 	didPrintHeaders       bool
 }
 
@@ -39,12 +63,13 @@ func NewCSVFormatter(q Query) (*CSVFormatter, error) {
 	formatter.Delimiter = ","
 	formatter.NullString = ""
 	formatter.query = q
+	formatter.types = q.Types()
 
 	return formatter, nil
 }
 
 func (c *CSVFormatter) writeRow(row []string, w io.Writer) (int, error) {
-	re, err := regexp.Compile(fmt.Sprintf("[\"%s]", c.Delimiter))
+	re, err := regexp.Compile(fmt.Sprintf("[\"\r\n%s]", regexp.QuoteMeta(c.Delimiter)))
 	if err != nil {
 		log.WithField("message", err.Error()).Errorf("Failed to compile embedded quotes expression: %v", err)
 		return 0, err
@@ -96,6 +121,27 @@ func (c *CSVFormatter) writeRow(row []string, w io.Writer) (int, error) {
 	return n, nil
 }
 
+// Formats a value of the column by its database type.  Dates and
+// timestamps are written in the layouts of the original CSV output rather
+// than as the driver's RFC 3339 strings.
+func (c *CSVFormatter) formatValue(col int, value string) string {
+	if col >= len(c.types) {
+		return value
+	}
+
+	switch c.types[col] {
+	case DBDate:
+		if t, ok := parseTimeValue(value); ok {
+			return t.Format(csvDateLayout)
+		}
+	case DBTimestamp:
+		if t, ok := parseTimeValue(value); ok {
+			return t.Format(csvTimestampLayout)
+		}
+	}
+	return value
+}
+
 func (c *CSVFormatter) writeHeaders(w io.Writer) (int, error) {
 	bytesWritten, err := c.writeRow(c.query.columns, w)
 	if err != nil {
@@ -120,10 +166,19 @@ func (c *CSVFormatter) Format(values []sql.NullString, w io.Writer) (int, error)
 		}
 	}
 
+	if len(c.BreakColumns) > 0 && c.BreakStyle != "" {
+		separatorBytes, err := c.writeBreak(values, w)
+		bytesWritten += separatorBytes
+		if err != nil {
+			log.WithField("message", err.Error()).Errorf("Failed to write break: %v", err)
+			return bytesWritten, err
+		}
+	}
+
 	row := make([]string, len(c.query.columns))
 	for i, v := range values {
 		if v.Valid {
-			row[i] = v.String
+			row[i] = c.formatValue(i, v.String)
 		} else {
 			row[i] = c.NullString
 		}
@@ -139,6 +194,91 @@ func (c *CSVFormatter) Format(values []sql.NullString, w io.Writer) (int, error)
 	return bytesWritten, nil
 }
 
+// Writes the separator for the previous group if the row starts a new
+// group, then adds the row to the current group
+func (c *CSVFormatter) writeBreak(values []sql.NullString, w io.Writer) (int, error) {
+	if c.breaks == nil {
+		breaks, err := newBreakTracker(c.query, c.BreakColumns)
+		if err != nil {
+			return 0, err
+		}
+		c.breaks = breaks
+		c.totals = newSubtotals(c.types, len(c.query.columns))
+	}
+
+	bytesWritten := 0
+	if c.breaks.next(values) && c.totals.rows > 0 {
+		var err error
+		switch c.BreakStyle {
+		case BreakBlank:
+			bytesWritten, err = w.Write(safeEOL)
+		case BreakSubtotal:
+			bytesWritten, err = c.writeSubtotal(w)
+		}
+
+		if err != nil {
+			return bytesWritten, err
+		}
+		c.totals.reset()
+	}
+
+	c.totals.add(values)
+	c.lastRow = append(c.lastRow[:0], values...)
+
+	return bytesWritten, nil
+}
+
+// Writes the subtotal line for the group ending with the last row.  The
+// break columns repeat the group's values and the first other column that
+// is not numeric is labeled as the subtotal.
+func (c *CSVFormatter) writeSubtotal(w io.Writer) (int, error) {
+	row := make([]string, len(c.query.columns))
+	labeled := false
+
+	for i := range row {
+		switch {
+		case c.breaks.isBreak(i):
+			if c.lastRow[i].Valid {
+				row[i] = c.lastRow[i].String
+			} else {
+				row[i] = c.NullString
+			}
+		case c.totals.numeric[i]:
+			row[i] = c.totals.total(i)
+		case !labeled:
+			row[i] = "Subtotal"
+			labeled = true
+		}
+	}
+
+	return c.writeRow(row, w)
+}
+
+// Finish writes the header row when the query returned no rows, and the
+// subtotal of the last group when subtotals are enabled.
+// It implements the Finisher interface for the CSVFormatter type.
+func (c *CSVFormatter) Finish(w io.Writer) (int, error) {
+	if !c.didPrintHeaders {
+		n, err := c.writeHeaders(w)
+		if err != nil {
+			log.WithField("message", err.Error()).Errorf("Failed to write headers: %v", err)
+		}
+		return n, err
+	}
+
+	if c.BreakStyle != BreakSubtotal || c.totals == nil || c.totals.rows == 0 {
+		return 0, nil
+	}
+
+	n, err := c.writeSubtotal(w)
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to write subtotal: %v", err)
+		return n, err
+	}
+
+	return n, nil
+}
+
 // ColumnCount returns the columns in the CSV formatter.
 // It implements the ColumnCounter interface for the CSVFormatter type.
 func (c *CSVFormatter) ColumnCount() int {
@@ -160,10 +300,12 @@ func (qp QueryProcessor) Process(query Query, w io.Writer) (int, error) {
 	startTime := time.Now()
 
 	log.WithField("startTime", startTime).Info("Start processing query")
-	defer log.WithFields(log.Fields{
-		"finished": time.Now(),
-		"duration": time.Since(startTime),
-	}).Info("Finished processing query")
+	defer func() {
+		log.WithFields(log.Fields{
+			"finished": time.Now(),
+			"duration": time.Since(startTime),
+		}).Info("Finished processing query")
+	}()
 
 	if qp.RowFormatter == nil {
 		qp.RowFormatter, err = NewCSVFormatter(query)
@@ -196,5 +338,20 @@ func (qp QueryProcessor) Process(query Query, w io.Writer) (int, error) {
 		}
 	}
 
+	err = query.result.Err()
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed reading result rows: %v", err)
+		return totalBytes, err
+	}
+
+	if finisher, ok := qp.RowFormatter.(Finisher); ok {
+		bytesFormatted, err := finisher.Finish(w)
+		totalBytes += bytesFormatted
+		if err != nil {
+			log.WithField("message", err.Error()).Errorf("Failed to finish formatted output: %v", err)
+			return totalBytes, err
+		}
+	}
+
 	return totalBytes, nil
 }
@@ -213,3 +213,96 @@ func TestProcessorWithEmbeddedDelimiters(t *testing.T) {
 		t.Error("Failed to match double quotes around embedded delimiter")
 	}
 }
+
+func TestProcessorDates(t *testing.T) {
+	query, err := ExecuteQuery(testConn, "select id, some_date from test_simple where id = 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	output := new(bytes.Buffer)
+
+	qp := QueryProcessor{}
+	_, err = qp.Process(query, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != "id,some_date\r\n4,01/04/2019\r\n" {
+		t.Errorf("Unexpected date output: %q", output.String())
+	}
+}
+
+func TestCSVFormatterTimestamps(t *testing.T) {
+	c := &CSVFormatter{types: []DBType{DBTimestamp, DBText}}
+
+	if v := c.formatValue(0, "2019-01-04T10:30:00Z"); v != "2019-01-04 10:30:00 +0000 UTC" {
+		t.Errorf("Unexpected timestamp: %s", v)
+	}
+	if v := c.formatValue(1, "2019-01-04T10:30:00Z"); v != "2019-01-04T10:30:00Z" {
+		t.Errorf("Expected text to be kept but got %s", v)
+	}
+}
+
+func TestCSVFormatterEmbeddedNewline(t *testing.T) {
+	c := &CSVFormatter{
+		Delimiter: ",",
+	}
+
+	b := new(bytes.Buffer)
+	_, err := c.writeRow([]string{"foo", "embedded\nnewline"}, b)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if b.String() != "foo,\"embedded\nnewline\"\r\n" {
+		t.Errorf("Expected embedded newline to be quoted: %s", b.String())
+	}
+}
+
+func TestCSVFormatBreakBlank(t *testing.T) {
+	c := &CSVFormatter{
+		Delimiter:    ",",
+		BreakColumns: []string{"id"},
+		BreakStyle:   BreakBlank,
+		query: Query{
+			columns: []string{"id", "name", "street", "amount"},
+		},
+	}
+
+	expected := "id,name,street,amount\r\n" +
+		"1,Acme,Main St,1.50\r\n" +
+		"1,Acme,Side St,2.25\r\n" +
+		"\r\n" +
+		"2,Bolt,High St,3\r\n"
+
+	actual := formatAll(t, c, groupedRows())
+	if actual != expected {
+		t.Errorf("Expected %q but got %q", expected, actual)
+	}
+}
+
+func TestCSVFormatBreakSubtotal(t *testing.T) {
+	c := &CSVFormatter{
+		Delimiter:    ",",
+		BreakColumns: []string{"id", "name"},
+		BreakStyle:   BreakSubtotal,
+		query: Query{
+			columns: []string{"id", "name", "street", "amount"},
+		},
+		types: []DBType{DBNumber, DBText, DBText, DBNumber},
+	}
+
+	expected := "id,name,street,amount\r\n" +
+		"1,Acme,Main St,1.50\r\n" +
+		"1,Acme,Side St,2.25\r\n" +
+		"1,Acme,Subtotal,3.75\r\n" +
+		"2,Bolt,High St,3\r\n" +
+		"2,Bolt,Subtotal,3\r\n"
+
+	actual := formatAll(t, c, groupedRows())
+	if actual != expected {
+		t.Errorf("Expected %q but got %q", expected, actual)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -26,6 +27,14 @@ const (
 	DBTime DBType = 3
 	// DBBytes is a raw byte column
 	DBBytes DBType = 4
+	// DBBoolean is a boolean column
+	DBBoolean DBType = 5
+	// DBTimestamp is a date and time column
+	DBTimestamp DBType = 6
+	// DBJSON is a JSON document column
+	DBJSON DBType = 7
+	// DBUUID is a UUID column
+	DBUUID DBType = 8
 	// DBUnknown is an unmpaped column type
 	DBUnknown DBType = 999
 )
@@ -43,11 +52,157 @@ func (d DBType) String() string {
 		return "Time"
 	case DBBytes:
 		return "Bytes"
+	case DBBoolean:
+		return "Boolean"
+	case DBTimestamp:
+		return "Timestamp"
+	case DBJSON:
+		return "JSON"
+	case DBUUID:
+		return "UUID"
 	}
 
 	return "Unknown"
 }
 
+// The high-level types of the database type names the drivers share.
+// Postgres reports its internal type names (int4, bpchar, timestamptz),
+// SQLite reports the type as declared in the table definition, and MySQL
+// reports its column types (tinyint, varbinary, unsigned bigint).
+var dbTypeNames = map[string]DBType{
+	"INT":                         DBNumber,
+	"INT2":                        DBNumber,
+	"INT4":                        DBNumber,
+	"INT8":                        DBNumber,
+	"SMALLINT":                    DBNumber,
+	"INTEGER":                     DBNumber,
+	"BIGINT":                      DBNumber,
+	"TINYINT":                     DBNumber,
+	"MEDIUMINT":                   DBNumber,
+	"YEAR":                        DBNumber,
+	"OID":                         DBNumber,
+	"NUMERIC":                     DBNumber,
+	"DECIMAL":                     DBNumber,
+	"FLOAT":                       DBNumber,
+	"FLOAT4":                      DBNumber,
+	"FLOAT8":                      DBNumber,
+	"REAL":                        DBNumber,
+	"DOUBLE":                      DBNumber,
+	"DOUBLE PRECISION":            DBNumber,
+	"MONEY":                       DBNumber,
+	"TEXT":                        DBText,
+	"VARCHAR":                     DBText,
+	"CHARACTER VARYING":           DBText,
+	"NVARCHAR":                    DBText,
+	"BPCHAR":                      DBText,
+	"CHAR":                        DBText,
+	"CHARACTER":                   DBText,
+	"NCHAR":                       DBText,
+	"NAME":                        DBText,
+	"CITEXT":                      DBText,
+	"CLOB":                        DBText,
+	"ENUM":                        DBText,
+	"SET":                         DBText,
+	"INTERVAL":                    DBText,
+	"DATE":                        DBDate,
+	"TIME":                        DBTime,
+	"TIMETZ":                      DBTime,
+	"TIME WITH TIME ZONE":         DBTime,
+	"TIME WITHOUT TIME ZONE":      DBTime,
+	"TIMESTAMP":                   DBTimestamp,
+	"TIMESTAMPTZ":                 DBTimestamp,
+	"TIMESTAMP WITH TIME ZONE":    DBTimestamp,
+	"TIMESTAMP WITHOUT TIME ZONE": DBTimestamp,
+	"DATETIME":                    DBTimestamp,
+	"BYTEA":                       DBBytes,
+	"BLOB":                        DBBytes,
+	"BINARY":                      DBBytes,
+	"VARBINARY":                   DBBytes,
+	"BOOL":                        DBBoolean,
+	"BOOLEAN":                     DBBoolean,
+	"JSON":                        DBJSON,
+	"JSONB":                       DBJSON,
+	"UUID":                        DBUUID,
+}
+
+// The type names only one driver reports, or reports with a meaning of
+// its own
+var driverTypeNames = map[string]map[string]DBType{
+	DriverPostgres: {
+		"BIT":    DBText,
+		"VARBIT": DBText,
+	},
+	DriverMySQL: {
+		"BIT":        DBBytes,
+		"TINYTEXT":   DBText,
+		"MEDIUMTEXT": DBText,
+		"LONGTEXT":   DBText,
+		"TINYBLOB":   DBBytes,
+		"MEDIUMBLOB": DBBytes,
+		"LONGBLOB":   DBBytes,
+	},
+}
+
+// MapDatabaseType maps the database type name reported by a driver to a
+// high-level type.  Array types (_int4 from Postgres or int[] as declared)
+// are represented as text, and MySQL's unsigned integers are numbers.  As
+// SQLite takes any declared type, names it does not recognize fall back to
+// the SQLite type affinity rules, so a column declared as "unsigned big
+// int" is still a number.  With an unknown driver the names of every
+// driver are recognized.
+func MapDatabaseType(driver string, name string) DBType {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if open := strings.Index(name, "("); open >= 0 {
+		rest := ""
+		if close := strings.Index(name, ")"); close > open {
+			rest = name[close+1:]
+		}
+		name = strings.TrimSpace(strings.TrimSpace(name[:open]) + rest)
+	}
+
+	if strings.HasPrefix(name, "_") || strings.HasSuffix(name, "]") {
+		return DBText
+	}
+
+	if driver == DriverMySQL {
+		name = strings.TrimPrefix(name, "UNSIGNED ")
+	}
+
+	if t, ok := driverTypeNames[driver][name]; ok {
+		return t
+	}
+	if t, ok := dbTypeNames[name]; ok {
+		return t
+	}
+
+	if driver == "" {
+		for _, d := range []string{DriverPostgres, DriverMySQL} {
+			if t, ok := driverTypeNames[d][strings.TrimPrefix(name, "UNSIGNED ")]; ok {
+				return t
+			}
+		}
+	}
+
+	if driver != DriverSQLite {
+		return DBUnknown
+	}
+
+	switch {
+	case name == "":
+		return DBUnknown
+	case strings.Contains(name, "INT"):
+		return DBNumber
+	case strings.Contains(name, "CHAR") || strings.Contains(name, "CLOB") || strings.Contains(name, "TEXT"):
+		return DBText
+	case strings.Contains(name, "BLOB"):
+		return DBBytes
+	case strings.Contains(name, "REAL") || strings.Contains(name, "FLOA") || strings.Contains(name, "DOUB"):
+		return DBNumber
+	}
+
+	return DBUnknown
+}
+
 // Query wraps an SQL query to expose its meta-data.
 // Wrapping the query results allows the API to define higher level
 // functions for interrogating the query metadata (such as the type).
@@ -56,6 +211,7 @@ type Query struct {
 	result        *sql.Rows
 	columns       []string
 	types         []*sql.ColumnType
+	driver        string
 }
 
 func logStartTime(t time.Time, i string) {
@@ -131,8 +287,17 @@ func ExecuteQuery(conn *sql.DB, query string, params ...interface{}) (Query, err
 	}, nil
 }
 
-// ExecuteQueryWithContext executes a query with an available context for cancelation
-func ExecuteQueryWithContext(ctx context.Context, conn *sql.DB, query string, params ...interface{}) (Query, error) {
+// Queryer is implemented by *sql.DB, *sql.Tx, and *sql.Conn, so a query can
+// be executed on the pool, in a transaction, or on a dedicated connection.
+type Queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ExecuteQueryWithContext executes a query with an available context for
+// cancelation.  The query stops when the context is done, while it executes
+// or while its rows are read, which is how timeouts and clients that went
+// away end it.
+func ExecuteQueryWithContext(ctx context.Context, conn Queryer, query string, params ...interface{}) (Query, error) {
 	requestID := RequestIDFromContext(ctx)
 
 	startTime := time.Now()
@@ -140,7 +305,6 @@ func ExecuteQueryWithContext(ctx context.Context, conn *sql.DB, query string, pa
 
 	defer logEndTime(startTime, requestID)
 
-	// TODO: The database query needs to be "cancellable"
 	rows, err := conn.QueryContext(ctx, query, params...)
 	if err != nil {
 		logError(err, requestID, "Failed to execute query with error: %v", err)
@@ -210,15 +374,28 @@ func (q Query) Type(column interface{}) (DBType, error) {
 		idx, err = q.IndexOf(name)
 	}
 
-	if err != nil {
+	if err != nil || idx < 0 || idx >= len(q.columns) {
 		return -1, fmt.Errorf("Unknown column %v, %d", column, idx)
 	}
 
-	//targetType := q.types[idx].DatabaseTypeName()
-	//switch {
-	//	case targetType == "VARCHAR" || targetType == "TEXT"
-	//}
-	return DBUnknown, nil
+	if idx >= len(q.types) {
+		return DBUnknown, nil
+	}
+
+	return MapDatabaseType(q.driver, q.types[idx].DatabaseTypeName()), nil
+}
+
+// Types returns the high-level type of every result column
+func (q Query) Types() []DBType {
+	types := make([]DBType, len(q.columns))
+	for i := range q.columns {
+		t, err := q.Type(i)
+		if err != nil {
+			t = DBUnknown
+		}
+		types[i] = t
+	}
+	return types
 }
 
 // Iterator is a function that can be passed into the query iterator
@@ -247,10 +424,12 @@ func (q Query) MakeBuffer() []interface{} {
 func (q Query) ForEach(i Iterator) error {
 	startTime := time.Now()
 	log.WithField("startTime", startTime).Info("Starting ForEach")
-	defer log.WithFields(log.Fields{
-		"duration": time.Since(startTime),
-		"finished": time.Now(),
-	}).Info("Finished ForEach")
+	defer func() {
+		log.WithFields(log.Fields{
+			"duration": time.Since(startTime),
+			"finished": time.Now(),
+		}).Info("Finished ForEach")
+	}()
 
 	buffer := q.MakeBuffer()
 
@@ -281,10 +460,12 @@ func (q Query) ForEach(i Iterator) error {
 func (q Query) Accumulate(a Accumulator, starting interface{}) (interface{}, error) {
 	startTime := time.Now()
 	log.WithField("startTime", startTime).Info("Starting accumulator")
-	defer log.WithFields(log.Fields{
-		"duration": time.Since(startTime),
-		"finished": time.Now(),
-	}).Info("Finished accumulator")
+	defer func() {
+		log.WithFields(log.Fields{
+			"duration": time.Since(startTime),
+			"finished": time.Now(),
+		}).Info("Finished accumulator")
+	}()
 
 	buffer := q.MakeBuffer()
 
@@ -31,6 +31,22 @@ func TestDBTypeString(t *testing.T) {
 		t.Errorf("Expected 'Time' but got %s", x.String())
 	}
 
+	if x = DBBoolean; x.String() != "Boolean" {
+		t.Errorf("Expected 'Boolean' but got %s", x.String())
+	}
+
+	if x = DBTimestamp; x.String() != "Timestamp" {
+		t.Errorf("Expected 'Timestamp' but got %s", x.String())
+	}
+
+	if x = DBJSON; x.String() != "JSON" {
+		t.Errorf("Expected 'JSON' but got %s", x.String())
+	}
+
+	if x = DBUUID; x.String() != "UUID" {
+		t.Errorf("Expected 'UUID' but got %s", x.String())
+	}
+
 	if x = DBUnknown; x.String() != "Unknown" {
 		t.Errorf("Expected 'Unknown' but got %s", x.String())
 	}
@@ -61,6 +77,103 @@ func TestExecuteQuery(t *testing.T) {
 	}
 }
 
+func TestMapDatabaseType(t *testing.T) {
+	expected := []struct {
+		driver string
+		name   string
+		dbType DBType
+	}{
+		{DriverPostgres, "INT4", DBNumber},
+		{DriverPostgres, "int8", DBNumber},
+		{DriverPostgres, "NUMERIC(10,2)", DBNumber},
+		{DriverPostgres, "MONEY", DBNumber},
+		{DriverPostgres, "FLOAT8", DBNumber},
+		{DriverPostgres, "BPCHAR", DBText},
+		{DriverPostgres, "_INT4", DBText},
+		{DriverPostgres, "TIMESTAMPTZ", DBTimestamp},
+		{DriverPostgres, "BYTEA", DBBytes},
+		{DriverPostgres, "BOOL", DBBoolean},
+		{DriverPostgres, "JSONB", DBJSON},
+		{DriverPostgres, "UUID", DBUUID},
+		{DriverPostgres, "INTERVAL", DBText},
+		{DriverPostgres, "BIT", DBText},
+		{DriverPostgres, "INT4RANGE", DBUnknown},
+		{DriverPostgres, "INT8RANGE", DBUnknown},
+		{DriverPostgres, "POINT", DBUnknown},
+		{DriverPostgres, "", DBUnknown},
+		{DriverSQLite, "unsigned big int", DBNumber},
+		{DriverSQLite, "varchar(30)", DBText},
+		{DriverSQLite, "int[]", DBText},
+		{DriverSQLite, "DATE", DBDate},
+		{DriverSQLite, "TIME", DBTime},
+		{DriverSQLite, "timestamp with time zone", DBTimestamp},
+		{DriverSQLite, "", DBUnknown},
+		{DriverMySQL, "UNSIGNED BIGINT", DBNumber},
+		{DriverMySQL, "TINYINT", DBNumber},
+		{DriverMySQL, "YEAR", DBNumber},
+		{DriverMySQL, "VARBINARY", DBBytes},
+		{DriverMySQL, "BIT", DBBytes},
+		{DriverMySQL, "ENUM", DBText},
+		{DriverMySQL, "MEDIUMTEXT", DBText},
+		{DriverMySQL, "LONGBLOB", DBBytes},
+		{DriverMySQL, "GEOMETRY", DBUnknown},
+		{"", "MEDIUMTEXT", DBText},
+		{"", "unsigned big int", DBUnknown},
+	}
+
+	for _, e := range expected {
+		if actual := MapDatabaseType(e.driver, e.name); actual != e.dbType {
+			t.Errorf("Expected %s from %s to map to %v but got %v", e.name, e.driver, e.dbType, actual)
+		}
+	}
+}
+
+func TestQueryType(t *testing.T) {
+	q, err := ExecuteQuery(testConn, "select * from test_basic_types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	expected := []DBType{DBNumber, DBNumber, DBNumber, DBNumber, DBNumber, DBNumber, DBText, DBText, DBText, DBText}
+	for i, dbType := range expected {
+		actual, err := q.Type(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != dbType {
+			t.Errorf("Expected %s to be %v but got %v", q.Columns()[i], dbType, actual)
+		}
+	}
+
+	actual, err := q.Type("sample_text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != DBText {
+		t.Errorf("Expected sample_text to be Text but got %v", actual)
+	}
+
+	_, err = q.Type(len(expected))
+	if err == nil {
+		t.Error("Expected an error for a column out of range")
+	}
+}
+
+func TestQueryDateTimeTypes(t *testing.T) {
+	q, err := ExecuteQuery(testConn, "select * from date_time_types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	types := q.Types()
+	if types[0] != DBDate || types[1] != DBTime || types[2] != DBTimestamp {
+		t.Errorf("Expected Date, Time, and Timestamp but got %v", types)
+	}
+}
+
 type testSimpleIter struct {
 	RowCount int
 }
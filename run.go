@@ -0,0 +1,205 @@
+package wysci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// An error resolving an endpoint's session settings for the principal
+type settingsError struct {
+	error
+}
+
+// An error of a query that ran longer than its timeout
+type timeoutError struct {
+	error
+}
+
+// Reports whether a query failed because it ran longer than its timeout,
+// either when the context's deadline passed or when Postgres stopped it at
+// its statement_timeout
+func queryTimedOut(ctx context.Context, err error) bool {
+	if ctx.Err() == context.DeadlineExceeded {
+		return true
+	}
+
+	e, ok := err.(*pq.Error)
+	return ok && e.Code == "57014" && strings.Contains(e.Message, "statement timeout")
+}
+
+// Limits the context to the timeout, unless it is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// The results of an endpoint's query with the session it runs in.  The
+// results of a mutating query depend on its transaction committing, so they
+// are held whole in memory and only written after the commit.
+type endpointResults struct {
+	Query
+	session     session
+	commitFirst bool
+}
+
+// Close closes the results and ends the session, rolling back a
+// transaction not committed
+func (r endpointResults) Close() error {
+	err := r.Query.Close()
+	r.session.end(false)
+	return err
+}
+
+// Commit closes the results and ends the session, committing its
+// transaction
+func (r endpointResults) Commit() error {
+	err := r.Query.Close()
+	if err != nil {
+		r.session.end(false)
+		return err
+	}
+	return r.session.end(true)
+}
+
+// Executes an endpoint's query with the request values and the principal
+// of the context.  Unless the query is mutating it runs read-only, and with
+// session settings it runs in a transaction with the settings applied.  On
+// Postgres a context deadline also becomes the transaction's
+// statement_timeout, so the server stops the query even when the
+// cancelation does not reach it.  Invalid values are reported as
+// ParameterErrors, unresolved settings as a settingsError, and a query that
+// ran out of time as a timeoutError.
+func executeEndpoint(ctx context.Context, db Database, queryConfig QueryConfig, config Endpoint, values url.Values) (endpointResults, error) {
+	principal := PrincipalFromContext(ctx)
+
+	parameters, err := extractParameters(config, values, principal)
+	if err != nil {
+		return endpointResults{}, err
+	}
+	if db.Driver == DriverSQLite {
+		sqliteTimes(config, parameters)
+	}
+
+	settings, err := sessionSettings(config.Settings, principal)
+	if err != nil {
+		return endpointResults{}, settingsError{err}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && db.Driver == DriverPostgres {
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining < 1 {
+			remaining = 1
+		}
+		settings = append(settings, sessionSetting{Name: "statement_timeout", Value: strconv.FormatInt(remaining, 10)})
+	}
+
+	s, err := startSession(ctx, db, queryConfig.Mutating, settings)
+	if err != nil {
+		if queryTimedOut(ctx, err) {
+			return endpointResults{}, timeoutError{err}
+		}
+		return endpointResults{}, err
+	}
+
+	statement, parameters := db.Rebind(queryConfig.SQL, parameters)
+	query, err := ExecuteQueryWithContext(ctx, s.queryer, statement, parameters...)
+	if err != nil {
+		s.end(false)
+		if queryTimedOut(ctx, err) {
+			return endpointResults{}, timeoutError{err}
+		}
+		return endpointResults{}, err
+	}
+	query.driver = db.Driver
+
+	return endpointResults{Query: query, session: s, commitFirst: queryConfig.Mutating}, nil
+}
+
+// RunEndpoint runs the named endpoint with the parameter values and writes
+// its results to w, as the request for the endpoint would without the HTTP
+// server.  The format is one the endpoint allows, or the endpoint's first
+// format when empty.  The query is stopped after its timeout.  The results
+// of a mutating query are held in memory and only written once its
+// transaction has committed.
+func RunEndpoint(ctx context.Context, config *Configuration, dbs Databases, name string, values url.Values, formatName string, w io.Writer) error {
+	endpoint, ok := config.Endpoints[name]
+	if !ok {
+		return fmt.Errorf("Unknown endpoint %s", name)
+	}
+
+	formats := endpointFormats(endpoint)
+	if len(formats) == 0 {
+		return fmt.Errorf("Endpoint %s has no known formats", name)
+	}
+
+	format := formats[0]
+	if formatName != "" {
+		found := false
+		for _, f := range formats {
+			if strings.EqualFold(f.Name, formatName) {
+				format, found = f, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Endpoint %s does not allow %s, available formats: %s",
+				name, formatName, strings.Join(endpointFormatNames(endpoint), ", "))
+		}
+	}
+
+	queryConfig := config.Queries[endpoint.QueryConfig]
+	db, err := dbs.For(queryConfig)
+	if err != nil {
+		return err
+	}
+
+	timeout := config.QueryTimeout(queryConfig)
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	results, err := executeEndpoint(ctx, db, queryConfig, endpoint, values)
+	if _, ok := err.(timeoutError); ok {
+		return fmt.Errorf("Endpoint %s exceeded its timeout of %v", name, timeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	formatter, err := format.NewFormatter(results.Query, endpoint, queryConfig)
+	if err != nil {
+		return err
+	}
+
+	out := w
+	held := new(bytes.Buffer)
+	if results.commitFirst {
+		out = held
+	}
+
+	qp := QueryProcessor{RowFormatter: formatter}
+	_, err = qp.Process(results.Query, out)
+	if err != nil && queryTimedOut(ctx, err) {
+		return fmt.Errorf("Endpoint %s exceeded its timeout of %v", name, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = results.Commit()
+	if err != nil || !results.commitFirst {
+		return err
+	}
+
+	_, err = held.WriteTo(w)
+	return err
+}
@@ -0,0 +1,138 @@
+package wysci
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunEndpoint(t *testing.T) {
+	b := new(bytes.Buffer)
+	err := RunEndpoint(context.Background(), testConfiguration(), testDBs, "simple", url.Values{"id": {"4"}}, "json", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(b.String(), `[{"id":4,"name":"embedded,comma"`) {
+		t.Errorf("Unexpected results %s", b.String())
+	}
+
+	b.Reset()
+	err = RunEndpoint(context.Background(), testConfiguration(), testDBs, "simple", url.Values{"id": {"4"}}, "", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(b.String(), "id,name,some_date\r\n") {
+		t.Errorf("Expected the default csv format but got %s", b.String())
+	}
+}
+
+func TestRunEndpointErrors(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Formats = []string{"csv"}
+	config.Endpoints["simple"] = endpoint
+
+	b := new(bytes.Buffer)
+	if err := RunEndpoint(context.Background(), config, testDBs, "missing", nil, "", b); err == nil {
+		t.Error("Expected an error for an unknown endpoint")
+	}
+
+	if err := RunEndpoint(context.Background(), config, testDBs, "simple", nil, "xlsx", b); err == nil {
+		t.Error("Expected an error for a format the endpoint does not allow")
+	}
+
+	err := RunEndpoint(context.Background(), config, testDBs, "simple", url.Values{"id": {"x"}}, "", b)
+	if _, ok := err.(ParameterErrors); !ok {
+		t.Errorf("Expected ParameterErrors but got %v", err)
+	}
+}
+
+// Counts for far longer than any test timeout
+const slowQuery = `with recursive counter(n) as (select 1 union all select n + 1 from counter)
+	select count(*) as n from (select n from counter limit 1000000000)`
+
+func TestQueryTimeout(t *testing.T) {
+	config := testConfiguration()
+	config.Connection.QueryTimeout = "30s"
+
+	expected := map[string]time.Duration{"": 30 * time.Second, "5m": 5 * time.Minute, "0s": 0}
+	for timeout, d := range expected {
+		if config.QueryTimeout(QueryConfig{Timeout: timeout}) != d {
+			t.Errorf("Expected %v for %q but got %v", d, timeout, config.QueryTimeout(QueryConfig{Timeout: timeout}))
+		}
+	}
+
+	config.Connection.QueryTimeout = ""
+	if config.QueryTimeout(QueryConfig{}) != 0 {
+		t.Error("Expected no timeout by default")
+	}
+}
+
+func TestEndpointTimeout(t *testing.T) {
+	config := testConfiguration()
+	config.Queries["slow"] = QueryConfig{SQL: slowQuery, Timeout: "50ms"}
+	config.Endpoints["slow"] = Endpoint{QueryConfig: "slow", Formats: []string{"json", "xlsx"}}
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/slow", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected 504 but got %d", w.Code)
+	}
+
+	expected := `[{"error":"The query of slow exceeded its timeout of 50ms"}]`
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("Expected %s but got %s", expected, w.Body.String())
+	}
+
+	if w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Expected no attachment for the error but got %s", w.Header().Get("Content-Disposition"))
+	}
+
+	b := new(bytes.Buffer)
+	err = RunEndpoint(context.Background(), config, testDBs, "slow", nil, "", b)
+	if err == nil || !strings.Contains(err.Error(), "exceeded its timeout of 50ms") {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+}
+
+func TestPostgresStatementTimeout(t *testing.T) {
+	conn, err := sql.Open("sqlite3_settings", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Postgres runs the query with the time left as its statement_timeout
+	db := Database{DB: conn, Driver: DriverPostgres}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	results, err := executeEndpoint(ctx, db, QueryConfig{SQL: "select current_setting('statement_timeout')"}, Endpoint{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer results.Close()
+
+	var timeout int
+	if !results.Result().Next() || results.Result().Scan(&timeout) != nil {
+		t.Fatal("Expected the statement_timeout")
+	}
+
+	if timeout <= 59000 || timeout > 60000 {
+		t.Errorf("Expected a statement_timeout of about a minute but got %dms", timeout)
+	}
+}
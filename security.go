@@ -0,0 +1,330 @@
+package wysci
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const principalKey = key(1)
+
+// Principal is the authenticated identity making a request
+type Principal struct {
+	User   string
+	Method string
+	Roles  []string
+	Claims map[string]interface{}
+}
+
+// ContextWithPrincipal adds the authenticated principal to the context
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// PrincipalFromContext returns the authenticated principal for the context
+// or nil if the request was not authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	if !ok {
+		return nil
+	}
+	return p
+}
+
+// The Authenticator interface is implemented by the authentication methods.
+// Authenticate returns the principal making the request.  It returns a nil
+// principal and a nil error when the request has none of the credentials the
+// method understands, so the next method can be tried.  An error means the
+// request had credentials but they are not valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Tries each authentication method in turn
+type authenticatorChain []Authenticator
+
+func (a authenticatorChain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range a {
+		p, err := auth.Authenticate(r)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+
+	return nil, fmt.Errorf("no credentials")
+}
+
+// NewAuthenticator creates the authenticator for the configured methods.
+// It returns nil when no methods are configured and requests do not need
+// to be authenticated.
+func NewAuthenticator(config Security) (Authenticator, error) {
+	if len(config.Methods) == 0 {
+		return nil, nil
+	}
+
+	chain := authenticatorChain{}
+	for _, method := range config.Methods {
+		switch method {
+		case "apikey":
+			auth, err := newAPIKeyAuthenticator(config.APIKey)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, auth)
+		case "proxy":
+			auth, err := newProxyAuthenticator(config.Proxy)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, auth)
+		case "certificate":
+			chain = append(chain, certificateAuthenticator{})
+		case "jwt":
+			auth, err := newJWTAuthenticator(config.JWT)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, auth)
+		default:
+			return nil, fmt.Errorf("Unknown authentication method %s", method)
+		}
+	}
+
+	return chain, nil
+}
+
+// HasRole returns true if the principal has any of the roles
+func (p *Principal) HasRole(roles ...string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, have := range p.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Authenticates a request, attaching the request ID and the principal to
+// the request context before calling the next handler.  When roles are
+// given the principal must have one of them.
+func secure(auth Authenticator, roles []string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := requestContext(r)
+		requestID := RequestIDFromContext(ctx)
+
+		var p *Principal
+		if auth != nil {
+			var err error
+			p, err = auth.Authenticate(r)
+			if err != nil {
+				log.Printf("[%s] Failed to authenticate %s: %v", requestID, r.URL.Path, err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			ctx = ContextWithPrincipal(ctx, p)
+		}
+
+		if len(roles) > 0 && !p.HasRole(roles...) {
+			log.Printf("[%s] Forbidden %s, requires one of %s", requestID, r.URL.Path, strings.Join(roles, ", "))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(ctx), ps)
+	}
+}
+
+type apiKeyAuthenticator struct {
+	header string
+	query  string
+	keys   []APIKey
+	hashes [][]byte
+}
+
+// Reads a keys file.  Each line has a key name, the hex SHA-256 hash of
+// the key, and optionally comma separated roles, separated by colons.
+// Blank lines and lines starting with # are ignored.
+func readKeysFile(path string) ([]APIKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := []APIKey{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected name:hash[:roles]", path, lineNumber)
+		}
+
+		k := APIKey{Name: strings.TrimSpace(parts[0]), Hash: strings.TrimSpace(parts[1])}
+		if len(parts) == 3 {
+			k.Roles = splitColumns(parts[2])
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, scanner.Err()
+}
+
+func newAPIKeyAuthenticator(config APIKeyConfig) (*apiKeyAuthenticator, error) {
+	auth := &apiKeyAuthenticator{
+		header: config.Header,
+		query:  config.Query,
+		keys:   config.Keys,
+	}
+
+	if auth.header == "" {
+		auth.header = "X-API-Key"
+	}
+
+	if config.KeysFile != "" {
+		keys, err := readKeysFile(config.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read API keys: %v", err)
+		}
+		auth.keys = append(append([]APIKey{}, auth.keys...), keys...)
+	}
+
+	auth.hashes = make([][]byte, len(auth.keys))
+	for i, k := range auth.keys {
+		hash, err := hex.DecodeString(strings.TrimPrefix(k.Hash, "sha256:"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key %s does not have a hex SHA-256 hash", k.Name)
+		}
+		auth.hashes[i] = hash
+	}
+
+	return auth, nil
+}
+
+// Authenticate implements the Authenticator interface for API keys
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	presented := r.Header.Get(a.header)
+	if presented == "" && a.query != "" {
+		presented = r.URL.Query().Get(a.query)
+	}
+
+	if presented == "" {
+		return nil, nil
+	}
+
+	hash := sha256.Sum256([]byte(presented))
+	for i, expected := range a.hashes {
+		if subtle.ConstantTimeCompare(hash[:], expected) == 1 {
+			return &Principal{User: a.keys[i].Name, Method: "apikey", Roles: a.keys[i].Roles}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown API key")
+}
+
+type proxyAuthenticator struct {
+	userHeader   string
+	groupsHeader string
+	trusted      []*net.IPNet
+}
+
+func newProxyAuthenticator(config ProxyConfig) (*proxyAuthenticator, error) {
+	auth := &proxyAuthenticator{
+		userHeader:   config.UserHeader,
+		groupsHeader: config.GroupsHeader,
+	}
+
+	if auth.userHeader == "" {
+		auth.userHeader = "X-Remote-User"
+	}
+
+	if auth.groupsHeader == "" {
+		auth.groupsHeader = "X-Remote-Groups"
+	}
+
+	if len(config.Trusted) == 0 {
+		return nil, fmt.Errorf("Proxy authentication requires trusted addresses")
+	}
+
+	for _, cidr := range config.Trusted {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy address %s: %v", cidr, err)
+		}
+		auth.trusted = append(auth.trusted, network)
+	}
+
+	return auth, nil
+}
+
+// Returns true if the request came directly from a trusted proxy
+func (a *proxyAuthenticator) isTrusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range a.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate implements the Authenticator interface for a reverse proxy
+// that passes the user and their groups in headers.  The headers are only
+// trusted from the configured proxy addresses.
+func (a *proxyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	user := strings.TrimSpace(r.Header.Get(a.userHeader))
+	if user == "" {
+		return nil, nil
+	}
+
+	if !a.isTrusted(r) {
+		return nil, fmt.Errorf("%s header from untrusted address %s", a.userHeader, r.RemoteAddr)
+	}
+
+	roles := []string{}
+	for _, header := range r.Header[http.CanonicalHeaderKey(a.groupsHeader)] {
+		roles = append(roles, splitColumns(header)...)
+	}
+
+	return &Principal{User: user, Method: "proxy", Roles: roles}, nil
+}
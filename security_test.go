@@ -0,0 +1,245 @@
+package wysci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func apiKeyConfiguration() *Configuration {
+	config := testConfiguration()
+	config.Security = Security{
+		Methods: []string{"apikey"},
+		APIKey: APIKeyConfig{
+			Query: "api_key",
+			Keys:  []APIKey{{Name: "reports", Hash: hashKey("s3cret")}},
+		},
+	}
+	return config
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	if p := PrincipalFromContext(context.Background()); p != nil {
+		t.Errorf("Expected no principal but got %v", p)
+	}
+
+	ctx := ContextWithPrincipal(context.Background(), &Principal{User: "someone"})
+	if p := PrincipalFromContext(ctx); p == nil || p.User != "someone" {
+		t.Errorf("Expected someone but got %v", p)
+	}
+}
+
+func TestNoAuthenticationMethods(t *testing.T) {
+	auth, err := NewAuthenticator(Security{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != nil {
+		t.Error("Expected no authenticator without methods")
+	}
+
+	_, err = NewAuthenticator(Security{Methods: []string{"magic"}})
+	if err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator(apiKeyConfiguration().Security)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+	r.Header.Set("X-API-Key", "s3cret")
+	p, err := auth.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.User != "reports" || p.Method != "apikey" {
+		t.Errorf("Expected the reports key but got %v", p)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/simple?api_key=s3cret", nil)
+	if p, err = auth.Authenticate(r); err != nil || p.User != "reports" {
+		t.Errorf("Expected the key from the query string: %v %v", p, err)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/simple", nil)
+	r.Header.Set("X-API-Key", "wrong")
+	if _, err = auth.Authenticate(r); err == nil {
+		t.Error("Expected an error for a wrong key")
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/simple", nil)
+	if _, err = auth.Authenticate(r); err == nil {
+		t.Error("Expected an error without a key")
+	}
+}
+
+func TestAPIKeyBadHash(t *testing.T) {
+	config := APIKeyConfig{Keys: []APIKey{{Name: "plain", Hash: "s3cret"}}}
+	if _, err := newAPIKeyAuthenticator(config); err == nil {
+		t.Error("Expected an error for a key that is not hashed")
+	}
+}
+
+func TestAPIKeysFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "wysci-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("# Report keys\n\nexcel: " + hashKey("from-excel") + ": sales, finance\n")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := newAPIKeyAuthenticator(APIKeyConfig{KeysFile: file.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+	r.Header.Set("X-API-Key", "from-excel")
+	if p, err := auth.Authenticate(r); err != nil || p.User != "excel" || !p.HasRole("finance") {
+		t.Errorf("Expected the excel key with its roles: %v %v", p, err)
+	}
+}
+
+func TestEndpointUnauthorized(t *testing.T) {
+	router, err := ConfigureEndpoints(apiKeyConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/v1/simple?id=4", "/api/v1", "/api/v1/openapi.json"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 401 {
+			t.Errorf("Expected 401 for %s but got %d", path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=4&api_key=s3cret", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected 200 but got %d", w.Code)
+	}
+}
+
+func proxyConfiguration() *Configuration {
+	config := testConfiguration()
+	config.Security = Security{
+		Methods: []string{"proxy"},
+		Proxy:   ProxyConfig{Trusted: []string{"10.1.0.0/16", "127.0.0.1"}},
+	}
+	return config
+}
+
+func TestProxyAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator(proxyConfiguration().Security)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/simple", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Remote-User", "jsmith")
+	r.Header.Set("X-Remote-Groups", "sales, finance")
+	p, err := auth.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.User != "jsmith" || !p.HasRole("finance") || p.HasRole("hr") {
+		t.Errorf("Unexpected principal %v", p)
+	}
+
+	r.RemoteAddr = "192.168.1.1:4567"
+	if _, err = auth.Authenticate(r); err == nil {
+		t.Error("Expected an error for an untrusted address")
+	}
+
+	if _, err = NewAuthenticator(Security{Methods: []string{"proxy"}}); err == nil {
+		t.Error("Expected an error without trusted addresses")
+	}
+}
+
+func TestEndpointRoles(t *testing.T) {
+	config := proxyConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Roles = []string{"finance"}
+	config.Endpoints["simple"] = endpoint
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		groups string
+		code   int
+	}{
+		{"sales", 403},
+		{"sales,finance", 200},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/simple?id=4", nil)
+		r.RemoteAddr = "127.0.0.1:4567"
+		r.Header.Set("X-Remote-User", "jsmith")
+		r.Header.Set("X-Remote-Groups", test.groups)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected %d for %s but got %d", test.code, test.groups, w.Code)
+		}
+	}
+}
+
+func TestValidateRolesWithoutAuthentication(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Roles = []string{"finance"}
+	config.Endpoints["simple"] = endpoint
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Key != "endpoints.simple.roles" {
+		t.Errorf("Expected an error for the roles but got %v", config.Validate())
+	}
+
+	config.Security = apiKeyConfiguration().Security
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected roles with an authentication method to be valid but got %v", err)
+	}
+}
+
+func TestValidatePrincipalWithoutAuthentication(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Parameters = map[string]Parameter{"id": {Type: "string", Ordinal: 1, Source: "principal.user"}}
+	endpoint.Settings = map[string]string{"app.tenant": "principal.claim.tenant_id", "role": "reporting"}
+	config.Endpoints["simple"] = endpoint
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok || len(errs) != 2 || errs[0].Key != "endpoints.simple.parameters.id.source" || errs[1].Key != "endpoints.simple.settings.app.tenant" {
+		t.Errorf("Expected errors for the source and the setting but got %v", config.Validate())
+	}
+
+	config.Security = apiKeyConfiguration().Security
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected principal values with an authentication method to be valid but got %v", err)
+	}
+}
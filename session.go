@@ -0,0 +1,102 @@
+package wysci
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// Begins transactions, as *sql.DB and *sql.Conn do
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Where a query runs: on the pool, or in a transaction when the query is
+// read-only or has session settings.  On SQLite, which has no read-only
+// transactions, a read-only query runs on a connection of its own with the
+// query_only pragma set.  A SQLite transaction always has a connection of
+// its own, since a failed commit leaves the connection in the transaction.
+type session struct {
+	queryer Queryer
+	tx      *sql.Tx
+	conn    *sql.Conn
+}
+
+// Starts the session of a query.  Unless the query is mutating it cannot
+// change the database: Postgres and MySQL run it in a read-only transaction
+// and SQLite with the query_only pragma.
+func startSession(ctx context.Context, db Database, mutating bool, settings []sessionSetting) (session, error) {
+	s := session{queryer: db}
+	var beginner txBeginner = db
+	var opts *sql.TxOptions
+
+	switch {
+	case mutating:
+		if db.Driver == DriverSQLite && len(settings) > 0 {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				return session{}, err
+			}
+			s.conn, beginner = conn, conn
+		}
+	case db.Driver == DriverSQLite:
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return session{}, err
+		}
+
+		_, err = conn.ExecContext(ctx, "pragma query_only = on")
+		if err != nil {
+			conn.Close()
+			return session{}, err
+		}
+
+		s.queryer, s.conn, beginner = conn, conn, conn
+	default:
+		opts = &sql.TxOptions{ReadOnly: true}
+	}
+
+	if opts != nil || len(settings) > 0 {
+		tx, err := beginWithSettings(ctx, beginner, opts, settings)
+		if err != nil {
+			s.end(false)
+			return session{}, err
+		}
+		s.queryer, s.tx = tx, tx
+	}
+
+	return s, nil
+}
+
+// Ends the session, committing or rolling back its transaction and
+// resetting the pragma of its connection before returning it to the pool.
+// Ending a session again does nothing.
+func (s session) end(commit bool) error {
+	var err error
+	if s.tx != nil {
+		if commit {
+			err = s.tx.Commit()
+			if err != nil && s.conn != nil {
+				// SQLite keeps the transaction open when the commit fails, for
+				// example on a deferred foreign key
+				_, rollbackErr := s.conn.ExecContext(context.Background(), "rollback")
+				if rollbackErr != nil {
+					log.Printf("Failed to roll back after the failed commit: %v", rollbackErr)
+				}
+			}
+		} else {
+			s.tx.Rollback()
+		}
+	}
+
+	if s.conn != nil {
+		// The query's context may be done, but the reset still has to happen
+		_, resetErr := s.conn.ExecContext(context.Background(), "pragma query_only = off")
+		if resetErr != nil && resetErr != sql.ErrConnDone {
+			log.Printf("Failed to reset the query_only pragma: %v", resetErr)
+		}
+		s.conn.Close()
+	}
+
+	return err
+}
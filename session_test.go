@@ -0,0 +1,95 @@
+package wysci
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyQueries(t *testing.T) {
+	_, err := testConn.Exec("create table test_read_only (id int); insert into test_read_only values (1);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testConn.Exec("drop table test_read_only")
+
+	config := testConfiguration()
+	config.Queries["purge"] = QueryConfig{SQL: "delete from test_read_only"}
+	config.Queries["add"] = QueryConfig{SQL: "insert into test_read_only values (2)", Mutating: true}
+	config.Endpoints["purge"] = Endpoint{QueryConfig: "purge"}
+	config.Endpoints["add"] = Endpoint{QueryConfig: "add"}
+
+	b := new(bytes.Buffer)
+	err = RunEndpoint(context.Background(), config, testDBs, "purge", nil, "", b)
+	if err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Errorf("Expected the delete to fail but got %v", err)
+	}
+
+	// The connection of the failed delete is back in the pool, writable again
+	err = RunEndpoint(context.Background(), config, testDBs, "add", nil, "", b)
+	if err != nil {
+		t.Errorf("Expected the mutating insert to succeed but got %v", err)
+	}
+
+	for _, e := range BuildCatalog(context.Background(), config, nil).Endpoints {
+		if e.Mutating != (e.Name == "add") {
+			t.Errorf("Unexpected mutating %v for %s", e.Mutating, e.Name)
+		}
+	}
+
+	var count int
+	err = testConn.QueryRow("select count(*) from test_read_only").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected the row to be kept and one added but got %d rows", count)
+	}
+}
+
+func TestCommitBeforeResponse(t *testing.T) {
+	conn, err := sql.Open("sqlite3_settings", "file::memory:?_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+
+	_, err = conn.Exec(`create table parent (id int primary key);
+		create table child (parent_id int references parent (id) deferrable initially deferred);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs := Databases{DefaultDatabase: {DB: conn, Driver: DriverSQLite}}
+	defer dbs.Close()
+
+	// The deferred foreign key fails the commit after the insert succeeded
+	config := testConfiguration()
+	config.Queries["orphan"] = QueryConfig{SQL: "insert into child values (1)", Mutating: true}
+	config.Endpoints["orphan"] = Endpoint{QueryConfig: "orphan", Settings: map[string]string{"app.mode": "test"}}
+
+	router, err := ConfigureEndpoints(config, dbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/orphan", nil))
+	if w.Code != 500 || strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		t.Errorf("Expected a 500 for the failed commit but got %d %s", w.Code, w.Body.String())
+	}
+
+	b := new(bytes.Buffer)
+	err = RunEndpoint(context.Background(), config, dbs, "orphan", nil, "", b)
+	if err == nil || !strings.Contains(err.Error(), "FOREIGN KEY") || b.Len() > 0 {
+		t.Errorf("Expected the failed commit without results but got %v %q", err, b.String())
+	}
+
+	config.Queries["orphan"] = QueryConfig{SQL: "insert into parent values (1)", Mutating: true}
+	err = RunEndpoint(context.Background(), config, dbs, "orphan", nil, "", b)
+	if err != nil || b.Len() == 0 {
+		t.Errorf("Expected the results after the commit but got %v %q", err, b.String())
+	}
+}
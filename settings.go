@@ -0,0 +1,60 @@
+package wysci
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// A session setting applied to an endpoint's transaction
+type sessionSetting struct {
+	Name  string
+	Value string
+}
+
+// Resolves an endpoint's settings for the principal.  A setting whose
+// value starts with principal. takes its value from the principal like a
+// parameter source, other values are used as is.  The settings are sorted
+// by name so they are applied in the same order on every request.
+func sessionSettings(settings map[string]string, p *Principal) ([]sessionSetting, error) {
+	resolved := make([]sessionSetting, 0, len(settings))
+	for name, value := range settings {
+		if strings.HasPrefix(value, "principal.") {
+			values, err := principalValues(p, value)
+			if err != nil {
+				return nil, err
+			}
+			value = strings.Join(values, ",")
+		}
+		resolved = append(resolved, sessionSetting{Name: name, Value: value})
+	}
+
+	sort.Slice(resolved, func(i, j int) bool {
+		return resolved[i].Name < resolved[j].Name
+	})
+
+	return resolved, nil
+}
+
+// Begins a transaction with the options and applies the settings to it
+// with set_config, which is SET LOCAL for a value passed as a parameter.
+// The settings end with the transaction, so they never leak to the next
+// user of the pooled connection.  Only Postgres has set_config, which
+// Validate checks for endpoints with settings.
+func beginWithSettings(ctx context.Context, beginner txBeginner, opts *sql.TxOptions, settings []sessionSetting) (*sql.Tx, error) {
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range settings {
+		_, err = tx.ExecContext(ctx, "select set_config($1, $2, true)", s.Name, s.Value)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
@@ -0,0 +1,97 @@
+package wysci
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Stands in for the Postgres settings functions in sqlite
+var (
+	testSettingsMutex sync.Mutex
+	testSettings      = map[string]string{}
+)
+
+func init() {
+	sql.Register("sqlite3_settings", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("set_config", func(name, value string, local bool) string {
+				testSettingsMutex.Lock()
+				defer testSettingsMutex.Unlock()
+				testSettings[name] = value
+				return value
+			}, false)
+			if err != nil {
+				return err
+			}
+
+			return conn.RegisterFunc("current_setting", func(name string) string {
+				testSettingsMutex.Lock()
+				defer testSettingsMutex.Unlock()
+				return testSettings[name]
+			}, false)
+		},
+	})
+}
+
+func TestSessionSettings(t *testing.T) {
+	p := &Principal{User: "jsmith", Roles: []string{"sales", "finance"}}
+	settings, err := sessionSettings(map[string]string{
+		"role":        "reporting",
+		"app.user_id": "principal.user",
+		"app.roles":   "principal.roles",
+	}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []sessionSetting{
+		{Name: "app.roles", Value: "sales,finance"},
+		{Name: "app.user_id", Value: "jsmith"},
+		{Name: "role", Value: "reporting"},
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("Expected %v but got %v", expected, settings)
+	}
+
+	_, err = sessionSettings(map[string]string{"app.user_id": "principal.user"}, nil)
+	if err == nil {
+		t.Error("Expected an error without a principal")
+	}
+}
+
+func TestEndpointSessionSettings(t *testing.T) {
+	conn, err := sql.Open("sqlite3_settings", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	config := apiKeyConfiguration()
+	config.Queries["whoami"] = QueryConfig{SQL: "select current_setting('app.user_id') as user_id"}
+	config.Endpoints["whoami"] = Endpoint{
+		QueryConfig: "whoami",
+		Settings:    map[string]string{"app.user_id": "principal.user"},
+	}
+
+	router, err := ConfigureEndpoints(config, Databases{DefaultDatabase: {DB: conn, Driver: DriverSQLite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/whoami?api_key=s3cret", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if lines := strings.Split(w.Body.String(), "\r\n"); len(lines) < 2 || lines[1] != "reports" {
+		t.Errorf("Expected the setting to be reports: %s", w.Body.String())
+	}
+}
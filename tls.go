@@ -0,0 +1,213 @@
+package wysci
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+var tlsReloadInterval = 10 * time.Second
+
+// The minimum TLS versions by name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Loads the certificate, key, and client CAs of a service, reloading them
+// when the files change
+type tlsFiles struct {
+	service  Service
+	minTLS   uint16
+	mutex    sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	config   *tls.Config
+}
+
+// UsesTLS returns true if the service is configured with a certificate
+func (s Service) UsesTLS() bool {
+	return s.CertFile != "" || s.KeyFile != ""
+}
+
+// Returns the files to watch
+func (f *tlsFiles) paths() []string {
+	paths := []string{f.service.CertFile, f.service.KeyFile}
+	if f.service.ClientCA != "" {
+		paths = append(paths, f.service.ClientCA)
+	}
+	return paths
+}
+
+// Returns the modification times of the files
+func (f *tlsFiles) stat() ([]time.Time, error) {
+	paths := f.paths()
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Reads the files into the configuration used for handshakes
+func (f *tlsFiles) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(f.service.CertFile, f.service.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   f.minTLS,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if f.service.ClientCA != "" {
+		pem, err := ioutil.ReadFile(f.service.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s has no certificates", f.service.ClientCA)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if f.service.ClientAuth == "optional" {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return config, nil
+}
+
+// Returns the current configuration, reloading the files if they changed
+// since they were last checked.  A failed reload keeps the previous
+// certificates so a half written file does not take the service down.
+func (f *tlsFiles) current() *tls.Config {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if time.Since(f.checked) < tlsReloadInterval {
+		return f.config
+	}
+	f.checked = time.Now()
+
+	modTimes, err := f.stat()
+	if err != nil {
+		log.Printf("Failed to check TLS certificates: %v", err)
+		return f.config
+	}
+
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(f.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return f.config
+	}
+
+	config, err := f.load()
+	if err != nil {
+		log.Printf("Failed to reload TLS certificates: %v", err)
+		return f.config
+	}
+
+	log.Printf("Reloaded TLS certificates")
+	f.config = config
+	f.modTimes = modTimes
+	return f.config
+}
+
+// NewTLSConfig creates the TLS configuration of a service.  The
+// certificate, key, and client CA files are read for each handshake after
+// they change, so renewed certificates are used without a restart.  With a
+// client CA the clients must present a certificate signed by it, unless
+// client_auth is optional.
+func NewTLSConfig(s Service) (*tls.Config, error) {
+	f := &tlsFiles{service: s, minTLS: tls.VersionTLS12}
+
+	if s.MinTLS != "" {
+		version, ok := tlsVersions[s.MinTLS]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version %s", s.MinTLS)
+		}
+		f.minTLS = version
+	}
+
+	if s.ClientAuth != "" && s.ClientAuth != "require" && s.ClientAuth != "optional" {
+		return nil, fmt.Errorf("Unknown client_auth %s, expected require or optional", s.ClientAuth)
+	}
+
+	var err error
+	f.modTimes, err = f.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f.config, err = f.load()
+	if err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+
+	return &tls.Config{
+		MinVersion: f.minTLS,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &f.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return f.current(), nil
+		},
+	}, nil
+}
+
+// Authenticates the client certificate verified during the TLS handshake.
+// The certificate's common name is the user and its organizational units
+// are the roles.
+type certificateAuthenticator struct{}
+
+// Authenticate implements the Authenticator interface for client certificates
+func (certificateAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, fmt.Errorf("client certificate %s has no common name", cert.Subject)
+	}
+
+	claims := map[string]interface{}{
+		"subject": cert.Subject.String(),
+		"issuer":  cert.Issuer.String(),
+		"serial":  cert.SerialNumber.String(),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		claims["email"] = cert.EmailAddresses[0]
+	}
+
+	return &Principal{
+		User:   cert.Subject.CommonName,
+		Method: "certificate",
+		Roles:  append([]string{}, cert.Subject.OrganizationalUnit...),
+		Claims: claims,
+	}, nil
+}
@@ -0,0 +1,198 @@
+package wysci
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A generated certificate and its key
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Generates a certificate signed by the parent, or self signed without one
+func generateCertificate(t *testing.T, serial int64, subject pkix.Name, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Writes the server certificate and key, setting their modification time
+func writeServerCertificate(t *testing.T, dir string, c testCertificate, modTime time.Time) {
+	for name, data := range map[string][]byte{"server.crt": c.certPEM, "server.key": c.keyPEM} {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	if _, err := NewTLSConfig(Service{CertFile: "missing.crt", KeyFile: "missing.key"}); err == nil {
+		t.Error("Expected an error for missing files")
+	}
+
+	if _, err := NewTLSConfig(Service{CertFile: "a", KeyFile: "b", MinTLS: "2.0"}); err == nil {
+		t.Error("Expected an error for an unknown TLS version")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wysci-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := generateCertificate(t, 1, pkix.Name{CommonName: "Test CA"}, nil)
+	server := generateCertificate(t, 2, pkix.Name{CommonName: "server"}, &ca)
+	client := generateCertificate(t, 3, pkix.Name{CommonName: "jsmith", OrganizationalUnit: []string{"finance"}}, &ca)
+
+	writeServerCertificate(t, dir, server, time.Now().Add(-time.Minute))
+	caPath := filepath.Join(dir, "ca.crt")
+	err = ioutil.WriteFile(caPath, ca.certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := Service{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		ClientCA: caPath,
+		MinTLS:   "1.2",
+	}
+
+	config, err := NewTLSConfig(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	users := make(chan string, 1)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := certificateAuthenticator{}.Authenticate(r)
+		if err != nil || p == nil || !p.HasRole("finance") {
+			users <- ""
+			return
+		}
+		users <- p.User
+	}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(certs []tls.Certificate) (*x509.Certificate, error) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, err := c.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0], nil
+	}
+
+	if _, err = get(nil); err == nil {
+		t.Error("Expected the handshake to fail without a client certificate")
+	}
+
+	peer, err := get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := <-users; user != "jsmith" {
+		t.Errorf("Expected the principal jsmith but got %q", user)
+	}
+	if peer.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected the first server certificate but got %v", peer.SerialNumber)
+	}
+
+	// Renew the server certificate
+	saved := tlsReloadInterval
+	tlsReloadInterval = 0
+	defer func() { tlsReloadInterval = saved }()
+
+	renewed := generateCertificate(t, 4, pkix.Name{CommonName: "server"}, &ca)
+	writeServerCertificate(t, dir, renewed, time.Now())
+
+	peer, err = get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-users
+	if peer.SerialNumber.Int64() != 4 {
+		t.Errorf("Expected the renewed server certificate but got %v", peer.SerialNumber)
+	}
+}
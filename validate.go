@@ -0,0 +1,475 @@
+package wysci
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigError describes a problem with a configuration setting.  The line
+// is 0 when the configuration was not loaded from a file.
+type ConfigError struct {
+	File    string
+	Line    int
+	Key     string
+	Message string
+}
+
+// Error implements the error interface
+func (c ConfigError) Error() string {
+	switch {
+	case c.File != "" && c.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", c.File, c.Line, c.Key, c.Message)
+	case c.File != "":
+		return fmt.Sprintf("%s: %s: %s", c.File, c.Key, c.Message)
+	}
+	return fmt.Sprintf("%s: %s", c.Key, c.Message)
+}
+
+// ConfigErrors holds every problem found in a configuration
+type ConfigErrors []ConfigError
+
+// Error implements the error interface
+func (c ConfigErrors) Error() string {
+	messages := make([]string, len(c))
+	for i, e := range c {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Where a configuration was loaded from
+type configSource struct {
+	path      string
+	lines     map[string]int
+	undecoded []toml.Key
+}
+
+// Splits a dotted TOML key into its parts, removing the quotes of quoted parts
+func splitKey(key string) []string {
+	parts := []string{}
+	part := strings.Builder{}
+	quote := rune(0)
+
+	for _, r := range key {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		case r != ' ' && r != '\t':
+			part.WriteRune(r)
+		}
+	}
+
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+// Returns the index of the first = that is not in a quoted key
+func assignmentIndex(line string) int {
+	quote := rune(0)
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '=':
+			return i
+		}
+	}
+	return -1
+}
+
+// Finds the line of each table and key of a TOML document.  The keys are
+// joined with dots as by toml.Key.String.  Only the first line of a key
+// repeated in an array of tables is kept.
+func keyLines(data string) map[string]int {
+	lines := map[string]int{}
+	table := []string{}
+	multiline := ""
+
+	for i, line := range strings.Split(data, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if multiline != "" {
+			if strings.Contains(trimmed, multiline) {
+				multiline = ""
+			}
+			continue
+		}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") {
+			header := strings.TrimLeft(trimmed, "[")
+			if end := strings.Index(header, "]"); end >= 0 {
+				header = header[:end]
+			}
+			table = splitKey(header)
+			key := strings.Join(table, ".")
+			if _, ok := lines[key]; !ok {
+				lines[key] = i + 1
+			}
+			continue
+		}
+
+		eq := assignmentIndex(trimmed)
+		if eq < 0 {
+			continue
+		}
+
+		key := strings.Join(append(append([]string{}, table...), splitKey(trimmed[:eq])...), ".")
+		if _, ok := lines[key]; !ok {
+			lines[key] = i + 1
+		}
+
+		value := strings.TrimSpace(trimmed[eq+1:])
+		for _, delimiter := range []string{`"""`, `'''`} {
+			if strings.HasPrefix(value, delimiter) && !strings.Contains(value[3:], delimiter) {
+				multiline = delimiter
+			}
+		}
+	}
+
+	return lines
+}
+
+// The parameter types an endpoint can declare
+var parameterTypes = map[string]bool{
+	"number":    true,
+	"string":    true,
+	"decimal":   true,
+	"boolean":   true,
+	"date":      true,
+	"timestamp": true,
+	"enum":      true,
+	"list":      true,
+}
+
+// Matches the $n placeholders of a query
+var placeholderPattern = regexp.MustCompile(`\$([0-9]+)`)
+
+// Returns the ordinals of the placeholders in a query
+func placeholders(sql string) map[int]bool {
+	ordinals := map[int]bool{}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(sql, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err == nil {
+			ordinals[n] = true
+		}
+	}
+	return ordinals
+}
+
+// Collects the problems of a configuration with their line numbers
+type validator struct {
+	source configSource
+	errs   ConfigErrors
+}
+
+// Adds a problem with the most specific line known for the key
+func (v *validator) add(key []string, format string, args ...interface{}) {
+	e := ConfigError{File: v.source.path, Key: strings.Join(key, "."), Message: fmt.Sprintf(format, args...)}
+
+	for i := len(key); i > 0 && e.Line == 0; i-- {
+		e.Line = v.source.lines[strings.Join(key[:i], ".")]
+	}
+
+	v.errs = append(v.errs, e)
+}
+
+// Validates the driver, pool, and SSL settings of a database
+func (v *validator) database(key []string, d DBConfig) {
+	driver := d.DriverName()
+	if !drivers[driver] {
+		v.add(append(key, "driver"), "unknown driver %q", d.Driver)
+		return
+	}
+
+	if d.MaxOpen < 0 {
+		v.add(append(key, "max_open"), "max_open must be 0 or more")
+	}
+	if d.MaxIdle < 0 {
+		v.add(append(key, "max_idle"), "max_idle must be 0 or more")
+	}
+
+	for setting, value := range map[string]string{"max_lifetime": d.MaxLifetime, "connect_timeout": d.ConnectTimeout} {
+		if _, err := optionalDuration(value); err != nil {
+			v.add(append(key, setting), "invalid duration %q", value)
+		}
+	}
+
+	if driver == DriverSQLite {
+		if d.SSLMode != "" || d.SSLRootCert != "" || d.SSLCert != "" || d.SSLKey != "" {
+			v.add(key, "SSL settings are not used by %s", driver)
+		}
+		return
+	}
+
+	if d.SSLMode != "" && !sslModes[driver][d.SSLMode] {
+		v.add(append(key, "ssl_mode"), "unknown ssl_mode %q for %s", d.SSLMode, driver)
+	}
+	if (d.SSLCert == "") != (d.SSLKey == "") {
+		v.add(key, "ssl_cert and ssl_key are needed together")
+	}
+	// The MySQL driver only falls back to an unencrypted connection
+	// without certificates of its own
+	if driver == DriverMySQL && d.SSLMode == "prefer" && (d.SSLRootCert != "" || d.SSLCert != "") {
+		v.add(append(key, "ssl_mode"), "ssl_mode prefer cannot be used with certificates on %s", driver)
+	}
+}
+
+// Validates a timeout, which is a duration of 0 or more
+func (v *validator) timeout(key []string, value string) {
+	d, err := optionalDuration(value)
+	if err != nil || d < 0 {
+		v.add(key, "invalid timeout %q", value)
+	}
+}
+
+// Validates one endpoint parameter
+func (v *validator) parameter(key []string, p Parameter) {
+	problems := len(v.errs)
+
+	if !parameterTypes[p.Type] {
+		v.add(append(key, "type"), "unknown parameter type %q", p.Type)
+	}
+
+	if p.Type == "list" && (p.Items == "list" || !parameterTypes[p.Items]) {
+		v.add(append(key, "items"), "unknown list item type %q", p.Items)
+	}
+
+	if (p.Type == "enum" || p.Items == "enum") && len(p.Values) == 0 {
+		v.add(key, "an enum needs values")
+	}
+
+	if p.Source != "" && p.Source != "principal.user" && p.Source != "principal.roles" &&
+		!strings.HasPrefix(p.Source, "principal.claim.") {
+		v.add(append(key, "source"), "unknown source %q", p.Source)
+	}
+
+	// The default is converted like a request value, which needs a valid
+	// parameter
+	def, ok := p.DefaultValue()
+	if !ok || len(v.errs) > problems {
+		return
+	}
+
+	var err error
+	if p.Type == "list" {
+		_, err = convertList(p, []string{def})
+	} else {
+		_, err = convertParameter(p, def)
+	}
+	if err != nil {
+		v.add(append(key, "default"), "invalid default: %v", err)
+	}
+}
+
+// Validates an endpoint, its query, and its parameters
+func (v *validator) endpoint(name string, e Endpoint, queries map[string]QueryConfig, drivers map[string]string) {
+	key := []string{"endpoints", name}
+
+	query, ok := queries[e.QueryConfig]
+	if !ok {
+		v.add(append(key, "query"), "unknown query %q", e.QueryConfig)
+	}
+
+	for _, f := range e.Formats {
+		if _, ok := LookupFormat(f); !ok {
+			v.add(append(key, "formats"), "unknown format %q", f)
+		}
+	}
+
+	if e.BreakStyle != "" && e.BreakStyle != BreakBlank && e.BreakStyle != BreakSubtotal {
+		v.add(append(key, "break_style"), "unknown break style %q", e.BreakStyle)
+	}
+
+	names := make([]string, 0, len(e.Parameters))
+	for pname := range e.Parameters {
+		names = append(names, pname)
+	}
+	sort.Strings(names)
+
+	ordinals := map[int]string{}
+	for _, pname := range names {
+		p := e.Parameters[pname]
+		pkey := append(append([]string{}, key...), "parameters", pname)
+		v.parameter(pkey, p)
+
+		switch other, duplicate := ordinals[p.Ordinal]; {
+		case p.Ordinal < 1:
+			v.add(append(pkey, "ordinal"), "ordinal must be 1 or more")
+		case duplicate:
+			v.add(append(pkey, "ordinal"), "ordinal %d is also used by %s", p.Ordinal, other)
+		default:
+			ordinals[p.Ordinal] = pname
+		}
+	}
+
+	segments := []string{}
+	for segment := range routeParameters(e.Route(name)) {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+	for _, segment := range segments {
+		if _, defined := e.Parameters[segment]; !defined {
+			v.add(append(key, "path"), "no parameter named %s for the path", segment)
+		}
+	}
+
+	if !ok {
+		return
+	}
+
+	// Settings are applied with set_config and lists bound as arrays,
+	// which only Postgres has
+	if driver := drivers[query.DatabaseName()]; driver != "" && driver != DriverPostgres {
+		if len(e.Settings) > 0 {
+			v.add(append(key, "settings"), "settings need a postgres database but query %s runs on %s", e.QueryConfig, driver)
+		}
+		for _, pname := range names {
+			if e.Parameters[pname].Type == "list" {
+				v.add(append(append([]string{}, key...), "parameters", pname, "type"),
+					"list parameters need a postgres database but query %s runs on %s", e.QueryConfig, driver)
+			}
+		}
+	}
+
+	used := placeholders(query.SQL)
+	for _, pname := range names {
+		p := e.Parameters[pname]
+		if p.Ordinal > 0 && !used[p.Ordinal] {
+			v.add(append(append([]string{}, key...), "parameters", pname, "ordinal"),
+				"query %s has no $%d", e.QueryConfig, p.Ordinal)
+		}
+	}
+
+	missing := []int{}
+	for n := range used {
+		if _, ok := ordinals[n]; !ok {
+			missing = append(missing, n)
+		}
+	}
+	sort.Ints(missing)
+	for _, n := range missing {
+		v.add(key, "no parameter has ordinal %d for $%d of query %s", n, n, e.QueryConfig)
+	}
+}
+
+// Reports the options of an endpoint that need an authenticated caller,
+// roles and values taken from the principal, when no authentication method
+// is configured
+func (v *validator) unauthenticated(name string, e Endpoint) {
+	key := []string{"endpoints", name}
+
+	if len(e.Roles) > 0 {
+		v.add(append(key, "roles"), "roles need an authentication method in security.methods")
+	}
+
+	names := make([]string, 0, len(e.Parameters))
+	for pname := range e.Parameters {
+		names = append(names, pname)
+	}
+	sort.Strings(names)
+	for _, pname := range names {
+		if p := e.Parameters[pname]; p.FromPrincipal() {
+			v.add(append(append([]string{}, key...), "parameters", pname, "source"),
+				"source %s needs an authentication method in security.methods", p.Source)
+		}
+	}
+
+	settings := make([]string, 0, len(e.Settings))
+	for setting := range e.Settings {
+		settings = append(settings, setting)
+	}
+	sort.Strings(settings)
+	for _, setting := range settings {
+		if value := e.Settings[setting]; strings.HasPrefix(value, "principal.") {
+			v.add(append(append([]string{}, key...), "settings", setting),
+				"%s needs an authentication method in security.methods", value)
+		}
+	}
+}
+
+// Validate reports every problem found in the configuration: settings that
+// are not known, invalid database settings and timeouts, queries with
+// unknown databases, endpoints with unknown queries, formats, or parameter
+// types, defaults that do not convert, path segments without a parameter,
+// settings and list parameters on databases other than Postgres, roles and
+// principal values without an authentication method, and parameter
+// ordinals that are duplicated or do not match the $n placeholders of the
+// query.  The problems are returned as ConfigErrors in the order of their
+// lines in the file.
+func (c *Configuration) Validate() error {
+	v := &validator{source: c.source}
+
+	for _, k := range c.source.undecoded {
+		v.add(k, "unknown setting")
+	}
+
+	v.database([]string{"database"}, c.Database)
+	for name, d := range c.Databases {
+		if name == DefaultDatabase {
+			v.add([]string{"databases", name}, "%s is the name of the [database] section", DefaultDatabase)
+		}
+		v.database([]string{"databases", name}, d)
+	}
+
+	if c.Connection.ConnectAttempts < 0 {
+		v.add([]string{"connection", "connect_attempts"}, "connect_attempts must be 0 or more")
+	}
+	v.timeout([]string{"connection", "query_timeout"}, c.Connection.QueryTimeout)
+
+	for name, q := range c.Queries {
+		if strings.TrimSpace(q.SQL) == "" {
+			v.add([]string{"queries", name, "sql"}, "query has no sql")
+		}
+
+		if _, ok := c.Databases[q.Database]; q.Database != "" && q.Database != DefaultDatabase && !ok {
+			v.add([]string{"queries", name, "database"}, "unknown database %q", q.Database)
+		}
+
+		v.timeout([]string{"queries", name, "timeout"}, q.Timeout)
+	}
+
+	drivers := map[string]string{DefaultDatabase: c.Database.DriverName()}
+	for name, d := range c.Databases {
+		if name != DefaultDatabase {
+			drivers[name] = d.DriverName()
+		}
+	}
+
+	for name, e := range c.Endpoints {
+		v.endpoint(name, e, c.Queries, drivers)
+		if len(c.Security.Methods) == 0 {
+			v.unauthenticated(name, e)
+		}
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Key < v.errs[j].Key
+	})
+
+	return v.errs
+}
@@ -1,15 +1,15 @@
 package wysci
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
-	"reflect"
-	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
@@ -25,266 +25,306 @@ func ContextWithRequestID(ctx context.Context) context.Context {
 }
 
 // RequestIDFromContext returns the request ID for the context
+// or the empty string if the context has no request ID.
 func RequestIDFromContext(ctx context.Context) string {
-	return ctx.Value(ridKey).(string)
+	rid, ok := ctx.Value(ridKey).(string)
+	if !ok {
+		return ""
+	}
+	return rid
 }
 
-func typeMetadata(rows *sql.Rows) ([]string, []string, error) {
-	names, err := rows.Columns()
-	if err != nil {
-		return nil, nil, err
+// Returns the request's context with a request ID, keeping the ID already
+// given to the request by the authentication middleware
+func requestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if RequestIDFromContext(ctx) == "" {
+		ctx = ContextWithRequestID(ctx)
 	}
+	return ctx
+}
 
-	types, err := rows.ColumnTypes()
+// Writes an error response with one row per problem in the negotiated
+// format, so clients can read errors the same way they read results
+func writeErrorRows(w http.ResponseWriter, status int, format OutputFormat, columns []string, rows [][]string) error {
+	formatter, err := format.NewFormatter(Query{columns: columns}, Endpoint{}, QueryConfig{})
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	typenames := make([]string, len(types))
-	for i := range types {
-		typenames[i] = types[i].DatabaseTypeName()
-	}
+	w.Header().Set("Content-Type", format.ContentType)
+	w.WriteHeader(status)
 
-	return names, typenames, nil
-}
+	values := make([]sql.NullString, len(columns))
+	for _, row := range rows {
+		for i := range values {
+			values[i] = sql.NullString{String: row[i], Valid: true}
+		}
 
-// Create a new buffer by allocating
-// TODO: need a more complete list of Postgres types (this may be okay for now)
-func createBuffer(typenames []string) []interface{} {
-	buffer := make([]interface{}, len(typenames))
-	// "VARCHAR", "TEXT", "NVARCHAR", "DECIMAL", "BOOL", "INT", "BIGINT"
-	for i, t := range typenames {
-		switch {
-		case t == "VARCHAR" || t == "TEXT" || t == "NVARCHAR" || t == "MONEY":
-			buffer[i] = new(sql.NullString)
-		case t == "TIMESTAMP" || t == "DATE":
-			buffer[i] = new(sql.NullTime)
-		case t == "DECIMAL":
-			buffer[i] = new(sql.NullFloat64)
-		case t == "BOOL":
-			buffer[i] = new(sql.NullBool)
-		case t == "INT" || t == "INT4":
-			buffer[i] = new(sql.NullInt32)
-		case t == "BIGINT":
-			buffer[i] = new(sql.NullInt64)
+		_, err = formatter.Format(values, w)
+		if err != nil {
+			return err
 		}
 	}
-	return buffer
-}
 
-// Safely cast out a string
-func castString(x interface{}) (*sql.NullString, error) {
-	strptr, ok := x.(*sql.NullString)
-	if !ok {
-		return nil, fmt.Errorf("Expected string ptr but got %v", reflect.TypeOf(x))
+	if finisher, ok := formatter.(Finisher); ok {
+		_, err = finisher.Finish(w)
 	}
-
-	return strptr, nil
+	return err
 }
 
-// Safely cast out an int32
-func castInt32(x interface{}) (*sql.NullInt32, error) {
-	int32ptr, ok := x.(*sql.NullInt32)
-	if !ok {
-		return nil, fmt.Errorf("Expected int ptr but got %v", reflect.TypeOf(x))
+// Writes a 400 response listing each invalid parameter
+func writeParameterErrors(w http.ResponseWriter, format OutputFormat, errs ParameterErrors) error {
+	rows := make([][]string, len(errs))
+	for i, e := range errs {
+		rows[i] = []string{e.Name, e.Type, e.Message}
 	}
 
-	return int32ptr, nil
+	return writeErrorRows(w, http.StatusBadRequest, format, []string{"parameter", "type", "error"}, rows)
 }
 
-func castInt64(x interface{}) (*sql.NullInt64, error) {
-	int64ptr, ok := x.(*sql.NullInt64)
-	if !ok {
-		return nil, fmt.Errorf("Expected int64 ptr but got %v", reflect.TypeOf(x))
-	}
-	return int64ptr, nil
+// Writes a 504 response for a query that ran longer than its timeout
+func writeTimeout(w http.ResponseWriter, format OutputFormat, name string, timeout time.Duration) error {
+	message := fmt.Sprintf("The query of %s exceeded its timeout of %v", name, timeout)
+	return writeErrorRows(w, http.StatusGatewayTimeout, format, []string{"error"}, [][]string{{message}})
 }
 
-func castFloat64(x interface{}) (*sql.NullFloat64, error) {
-	float32Ptr, ok := x.(*sql.NullFloat64)
-	if !ok {
-		return nil, fmt.Errorf("Expected float64 ptr but got %v", reflect.TypeOf(x))
-	}
-	return float32Ptr, nil
+// How much of a response is held before it is sent
+const pendingLimit = 4096
+
+// Holds the start of a response until it grows past the pending limit or is
+// sent, so a query that times out before any of its response was sent can
+// be answered with an error instead.  A held response is kept whole until
+// it is sent.
+type pendingResponse struct {
+	http.ResponseWriter
+	buffer bytes.Buffer
+	sent   bool
+	held   bool
 }
 
-func castBool(x interface{}) (*sql.NullBool, error) {
-	boolPtr, ok := x.(*sql.NullBool)
-	if !ok {
-		return nil, fmt.Errorf("Expected bool ptr but got %v", reflect.TypeOf(x))
+// Write implements the io.Writer interface
+func (p *pendingResponse) Write(b []byte) (int, error) {
+	if p.sent {
+		return p.ResponseWriter.Write(b)
 	}
-	return boolPtr, nil
-}
 
-func castTime(x interface{}) (*sql.NullTime, error) {
-	timePtr, ok := x.(*sql.NullTime)
-	if !ok {
-		return nil, fmt.Errorf("Expected time ptr but got %v", reflect.TypeOf(x))
+	p.buffer.Write(b)
+	if p.buffer.Len() >= pendingLimit && !p.held {
+		return len(b), p.send()
 	}
-	return timePtr, nil
+	return len(b), nil
 }
 
-// Scan a row into a buffer
-func scanRow(rows *sql.Rows, buffer []interface{}, typenames []string) []string {
-	rows.Scan(buffer...)
-	parts := []string{}
+// Sends the response held so far
+func (p *pendingResponse) send() error {
+	p.sent = true
+	_, err := p.ResponseWriter.Write(p.buffer.Bytes())
+	p.buffer.Reset()
+	return err
+}
 
-	for idx, v := range buffer {
-		t := typenames[idx]
-		switch {
-		case t == "VARCHAR" || t == "TEXT" || t == "NVCHAR" || t == "MONEY":
-			s, err := castString(v)
-			if err != nil {
-				log.Printf("Unable to cast to string: %v", err)
-				continue
-			}
+func makeHandler(db Database, queryConfig QueryConfig, timeout time.Duration, name string, config Endpoint) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx, cancel := withTimeout(requestContext(r), timeout)
+		defer cancel()
+		requestID := RequestIDFromContext(ctx)
 
-			if s.Valid {
-				parts = append(parts, s.String)
-			} else {
-				parts = append(parts, "")
-			}
-		case t == "TIMESTAMP" || t == "DATE":
-			s, err := castTime(v)
-			if err != nil {
-				log.Printf("Unable to cast time: %v", err)
-				continue
-			}
+		if p := PrincipalFromContext(ctx); p != nil {
+			log.Printf("[%s] Executing %s for %s", requestID, name, p.User)
+		} else {
+			log.Printf("[%s] Executing %s", requestID, name)
+		}
+		format, ok := negotiateFormat(r, config)
+		if !ok {
+			log.Printf("[%s] No acceptable format for %s", requestID, name)
+			http.Error(w, fmt.Sprintf("Not acceptable, available formats: %s",
+				strings.Join(endpointFormatNames(config), ", ")), http.StatusNotAcceptable)
+			return
+		}
+
+		// Path parameters take precedence over the query string
+		values := r.URL.Query()
+		for _, p := range ps {
+			values.Set(p.Key, p.Value)
+		}
 
-			if s.Valid {
-				switch {
-				case t == "TIMESTAMP":
-					parts = append(parts, fmt.Sprintf("%v", s.Time))
-				case t == "DATE":
-					parts = append(parts, s.Time.Format("01/02/2006"))
+		query, err := executeEndpoint(ctx, db, queryConfig, config, values)
+		if err != nil {
+			switch e := err.(type) {
+			case ParameterErrors:
+				log.Printf("[%s] Invalid parameters for %s: %v", requestID, name, err)
+				err = writeParameterErrors(w, format, e)
+				if err != nil {
+					log.Printf("[%s] Failed to write parameter errors: %v", requestID, err)
 				}
-			} else {
-				parts = append(parts, "")
-			}
-		case t == "DECIMAL":
-			f, err := castFloat64(v)
-			if err != nil {
-				log.Printf("unable to cast to float: %v", err)
-				continue
+			case settingsError:
+				log.Printf("[%s] Failed to resolve session settings for %s: %v", requestID, name, err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			case timeoutError:
+				log.Printf("[%s] Query of %s exceeded its timeout of %v: %v", requestID, name, timeout, err)
+				err = writeTimeout(w, format, name, timeout)
+				if err != nil {
+					log.Printf("[%s] Failed to write the timeout: %v", requestID, err)
+				}
+			default:
+				log.Printf("[%s] Failed to execute query: %v", requestID, err)
+				w.WriteHeader(http.StatusInternalServerError)
 			}
+			return
+		}
+		defer query.Close()
 
-			if f.Valid {
-				parts = append(parts, fmt.Sprintf("%f", f.Float64))
-			} else {
-				parts = append(parts, "")
-			}
-		case t == "BOOL":
-			b, err := castBool(v)
-			if err != nil {
-				log.Printf("Unable to cast to bool: %v", err)
-				continue
-			}
+		formatter, err := format.NewFormatter(query.Query, config, queryConfig)
+		if err != nil {
+			log.Printf("[%s] Failed to create %s formatter: %v", requestID, format.Name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-			if b.Valid {
-				parts = append(parts, fmt.Sprintf("%v", b.Bool))
-			} else {
-				parts = append(parts, "")
-			}
-		case t == "INT4":
-			i, err := castInt32(v)
-			if err != nil {
-				log.Printf("Unable to cast to int32: %v", err)
-				continue
+		w.Header().Set("Content-Type", format.ContentType)
+		if disposition := format.ContentDisposition(name); disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+
+		if len(config.Headers) > 0 {
+			for name, val := range config.Headers {
+				// The format decides what the response is
+				switch http.CanonicalHeaderKey(name) {
+				case "Content-Type", "Content-Disposition":
+					continue
+				}
+				w.Header().Set(name, val)
 			}
+		}
 
-			if i.Valid {
-				parts = append(parts, fmt.Sprintf("%d", i.Int32))
-			} else {
-				parts = append(parts, "")
+		pending := &pendingResponse{ResponseWriter: w, held: query.commitFirst}
+		qp := QueryProcessor{RowFormatter: formatter}
+		_, err = qp.Process(query.Query, pending)
+		if err != nil && !pending.sent && queryTimedOut(ctx, err) {
+			log.Printf("[%s] Query of %s exceeded its timeout of %v: %v", requestID, name, timeout, err)
+			w.Header().Del("Content-Disposition")
+			err = writeTimeout(w, format, name, timeout)
+			if err != nil {
+				log.Printf("[%s] Failed to write the timeout: %v", requestID, err)
 			}
-		case t == "BIGINT":
-			b, err := castInt64(v)
+			return
+		}
+		if err == nil && pending.held {
+			err = query.Commit()
 			if err != nil {
-				log.Printf("Unable to cast to int64: %v", err)
-				continue
+				log.Printf("[%s] Failed to commit: %v", requestID, err)
+				w.Header().Del("Content-Disposition")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
 			}
+		}
+		if err != nil && !pending.sent {
+			log.Printf("[%s] Failed to format %s response: %v", requestID, format.Name, err)
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			err = pending.send()
+		}
+		if err != nil {
+			log.Printf("[%s] Failed to format %s response: %v", requestID, format.Name, err)
+			// Part of the response is already on the wire, so aborting is the
+			// only way to tell the client the results are truncated.  The server
+			// closes the connection without ending the response.
+			panic(http.ErrAbortHandler)
+		}
 
-			if b.Valid {
-				parts = append(parts, fmt.Sprintf("%d", b.Int64))
-			} else {
-				parts = append(parts, "")
+		if !pending.held {
+			err = query.Commit()
+			if err != nil {
+				log.Printf("[%s] Failed to commit: %v", requestID, err)
 			}
 		}
 	}
-
-	return parts
 }
 
-// Appends a line to the CSV response
-func appendCSVLine(w http.ResponseWriter, row []string) {
-	w.Write([]byte(strings.Join(row, ",")))
-	w.Write([]byte("\r\n"))
+// Route returns the path of the named endpoint under /api/v1.  The path
+// is the endpoint's path template or, without one, the endpoint's name.
+func (e Endpoint) Route(name string) string {
+	if e.Path == "" {
+		return fmt.Sprintf("/api/v1/%s", name)
+	}
+
+	return fmt.Sprintf("/api/v1/%s", strings.TrimPrefix(e.Path, "/"))
 }
 
-func extractParameters(name string, config Endpoint, url *url.URL) []interface{} {
-	parameters := make([]interface{}, len(config.Parameters))
-	for pname, pdesc := range config.Parameters {
-		raw := url.Query().Get(pname)
-		switch {
-		case pdesc.Type == "number":
-			val, err := strconv.ParseInt(raw, 10, 64)
-			if err != nil {
-				log.Printf("Failed to configure %s: %v", name, err)
-				continue
-			}
-			parameters[pdesc.Ordinal-1] = val
-		case pdesc.Type == "string":
-			parameters[pdesc.Ordinal-1] = raw
+// Adds a GET route, returning the router's panic for a conflicting path as an error
+func addRoute(router *httprouter.Router, path string, handle httprouter.Handle) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Failed to add route %s: %v", path, r)
 		}
-	}
-	return parameters
+	}()
+
+	router.GET(path, handle)
+	return nil
 }
 
-func makeHandler(conn *sql.DB, sql string, name string, config Endpoint) func(http.ResponseWriter, *http.Request, httprouter.Params) {
-	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		log.Printf("Executing %s", name)
-		parameters := extractParameters(name, config, r.URL)
+// ConfigureEndpoints configures the service endpoints.  Each endpoint's
+// query runs on the connection pool of its database.
+func ConfigureEndpoints(config *Configuration, dbs Databases) (*httprouter.Router, error) {
+	auth, err := NewAuthenticator(config.Security)
+	if err != nil {
+		return nil, err
+	}
+
+	router := httprouter.New()
+
+	catalog := &catalogCache{config: config, dbs: dbs}
+	router.GET("/api/v1", secure(auth, nil, makeCatalogHandler(catalog)))
+	router.GET("/api/v1/openapi.json", secure(auth, nil, makeOpenAPIHandler(catalog)))
 
-		result, err := conn.Query(sql, parameters...)
+	for name, endpoint := range config.Endpoints {
+		query := config.Queries[endpoint.QueryConfig]
+		db, err := dbs.For(query)
 		if err != nil {
-			log.Printf("Failed to execute query: %v", err)
-			w.WriteHeader(500)
-			return
+			return nil, fmt.Errorf("Endpoint %s: %v", name, err)
 		}
-		defer result.Close()
 
-		columns, typenames, err := typeMetadata(result)
+		route := endpoint.Route(name)
+		log.Printf("Adding %s", route)
+		err = addRoute(router, route, secure(auth, endpoint.Roles, makeHandler(db, query, config.QueryTimeout(query), name, endpoint)))
 		if err != nil {
-			log.Printf("Failed to get result metadata: %v", err)
-			w.WriteHeader(500)
-			return
+			return nil, err
 		}
+	}
 
-		if len(config.Headers) > 0 {
-			for name, val := range config.Headers {
-				w.Header().Add(name, val)
-			}
-		}
+	return router, nil
+}
 
-		appendCSVLine(w, columns)
-		values := createBuffer(typenames)
-		for result.Next() {
-			parts := scanRow(result, values, typenames)
-			appendCSVLine(w, parts)
-		}
-	}
+// Holds the handler in an atomic.Value, which needs the same concrete type
+// for every value stored
+type handlerValue struct {
+	http.Handler
 }
 
-// ConfigureEndpoints configures the service endpoints
-func ConfigureEndpoints(config *Configuration, conn *sql.DB) (*httprouter.Router, error) {
-	router := httprouter.New()
+// SwappableHandler serves requests with a handler that can be replaced
+// while serving, such as the router of a reloaded configuration.  Requests
+// in flight finish on the handler that started them.
+type SwappableHandler struct {
+	current atomic.Value
+}
 
-	for name, endpoint := range config.Endpoints {
-		query := config.Queries[endpoint.QueryConfig]
+// NewSwappableHandler creates a SwappableHandler serving with the handler
+func NewSwappableHandler(h http.Handler) *SwappableHandler {
+	s := &SwappableHandler{}
+	s.Swap(h)
+	return s
+}
 
-		log.Printf("Adding /api/v1/%s", name)
-		router.GET(fmt.Sprintf("/api/v1/%s", name), makeHandler(conn, query.SQL, name, endpoint))
-	}
+// Swap replaces the handler for new requests
+func (s *SwappableHandler) Swap(h http.Handler) {
+	s.current.Store(handlerValue{h})
+}
 
-	return router, nil
+// ServeHTTP implements the http.Handler interface
+func (s *SwappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().(handlerValue).ServeHTTP(w, r)
 }
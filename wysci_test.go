@@ -0,0 +1,316 @@
+package wysci
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testConfiguration() *Configuration {
+	return &Configuration{
+		Queries: map[string]QueryConfig{
+			"simple": {SQL: "select id, name, some_date from test_simple where id = $1"},
+		},
+		Endpoints: map[string]Endpoint{
+			"simple": {
+				QueryConfig: "simple",
+				Parameters: map[string]Parameter{
+					"id": {Type: "number", Ordinal: 1},
+				},
+			},
+		},
+	}
+}
+
+func TestRequestIDFromContext(t *testing.T) {
+	if rid := RequestIDFromContext(context.Background()); rid != "" {
+		t.Errorf("Expected no request ID but got %s", rid)
+	}
+
+	ctx := ContextWithRequestID(context.Background())
+	if rid := RequestIDFromContext(ctx); rid == "" {
+		t.Error("Expected a request ID")
+	}
+}
+
+func TestEndpointCSV(t *testing.T) {
+	router, err := ConfigureEndpoints(testConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=4", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Expected text/csv but got %s", ct)
+	}
+
+	lines := strings.Split(w.Body.String(), "\r\n")
+	if lines[0] != "id,name,some_date" {
+		t.Errorf("Unexpected header row: %s", lines[0])
+	}
+
+	if !strings.HasPrefix(lines[1], "4,\"embedded,comma\",") {
+		t.Errorf("Expected embedded comma to be quoted: %s", lines[1])
+	}
+}
+
+func TestEndpointNoRows(t *testing.T) {
+	router, err := ConfigureEndpoints(testConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, header := range map[string]string{
+		"csv": "id,name,some_date\r\n",
+		"tsv": "id\tname\tsome_date\r\n",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=99&format="+format, nil))
+
+		if w.Code != 200 {
+			t.Fatalf("Expected 200 for %s but got %d", format, w.Code)
+		}
+
+		if w.Body.String() != header {
+			t.Errorf("Expected only the %s header row but got %q", format, w.Body.String())
+		}
+	}
+}
+
+func TestEndpointSQLiteDateParameter(t *testing.T) {
+	config := testConfiguration()
+	config.Queries["byDate"] = QueryConfig{SQL: "select id from test_simple where some_date = $1"}
+	config.Endpoints["byDate"] = Endpoint{
+		QueryConfig: "byDate",
+		Parameters:  map[string]Parameter{"day": {Type: "date", Ordinal: 1, Required: true}},
+	}
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/byDate?day=2019-01-04", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if w.Body.String() != "id\r\n4\r\n" {
+		t.Errorf("Expected the row of 2019-01-04 but got %q", w.Body.String())
+	}
+}
+
+func TestEndpointNullColumns(t *testing.T) {
+	router, err := ConfigureEndpoints(testConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=2&format=json", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), `"name":null`) {
+		t.Errorf("Expected a null name: %s", w.Body.String())
+	}
+}
+
+func TestEndpointConfiguredHeaders(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Headers = map[string]string{"content-type": "text/csv", "Cache-Control": "no-store"}
+	config.Endpoints["simple"] = endpoint
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=1&format=json", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected the negotiated application/json but got %s", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Expected the configured Cache-Control but got %s", cc)
+	}
+}
+
+func TestEndpointNotAcceptable(t *testing.T) {
+	router, err := ConfigureEndpoints(testConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/simple?id=1", nil)
+	r.Header.Set("Accept", "image/png")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != 406 {
+		t.Errorf("Expected 406 but got %d", w.Code)
+	}
+}
+
+func TestEndpointParameterErrors(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Parameters["id"] = Parameter{Type: "number", Ordinal: 1, Required: true}
+	config.Endpoints["simple"] = endpoint
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?format=json", nil))
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400 but got %d", w.Code)
+	}
+
+	expected := `[{"parameter":"id","type":"number","error":"required parameter is missing"}]`
+	if w.Body.String() != expected {
+		t.Errorf("Expected %s but got %s", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple?id=abc", nil))
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400 but got %d", w.Code)
+	}
+
+	if !strings.HasPrefix(w.Body.String(), "parameter,type,error\r\nid,number,") {
+		t.Errorf("Expected a CSV error body but got %s", w.Body.String())
+	}
+}
+
+func TestEndpointRoute(t *testing.T) {
+	if route := (Endpoint{}).Route("sales"); route != "/api/v1/sales" {
+		t.Errorf("Expected /api/v1/sales but got %s", route)
+	}
+
+	e := Endpoint{Path: "/customers/:customerId/sales"}
+	if route := e.Route("sales"); route != "/api/v1/customers/:customerId/sales" {
+		t.Errorf("Expected /api/v1/customers/:customerId/sales but got %s", route)
+	}
+}
+
+func TestEndpointPathParameters(t *testing.T) {
+	config := testConfiguration()
+	endpoint := config.Endpoints["simple"]
+	endpoint.Path = "/simple/:id"
+	config.Endpoints["simple"] = endpoint
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/simple/4?id=1", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 but got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "embedded,comma") {
+		t.Errorf("Expected the path parameter to select row 4: %s", w.Body.String())
+	}
+}
+
+func TestEndpointConflictingPaths(t *testing.T) {
+	config := testConfiguration()
+	config.Endpoints["byId"] = Endpoint{QueryConfig: "simple", Path: "/things/:id"}
+	config.Endpoints["byName"] = Endpoint{QueryConfig: "simple", Path: "/things/:name"}
+
+	_, err := ConfigureEndpoints(config, testDBs)
+	if err == nil {
+		t.Error("Expected an error for conflicting paths")
+	}
+}
+
+func TestEndpointAbortsTruncatedResponse(t *testing.T) {
+	config := testConfiguration()
+	// Overflows on the last row, after the start of the response was sent
+	config.Queries["overflow"] = QueryConfig{SQL: `with recursive n(i) as (select 1 union all select i + 1 from n where i < 2000)
+		select i, abs(-9223372036854775807 - i / 2000) from n`}
+	config.Endpoints["overflow"] = Endpoint{QueryConfig: "overflow"}
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("Expected the handler to abort but got %v", r)
+		}
+	}()
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/overflow", nil))
+}
+
+func TestEndpointErrorBeforeResponse(t *testing.T) {
+	config := testConfiguration()
+	config.Queries["grouped"] = QueryConfig{SQL: "select id, name from test_simple", Break: "cust"}
+	config.Endpoints["grouped"] = Endpoint{QueryConfig: "grouped"}
+
+	router, err := ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/grouped?format=json", nil))
+
+	if w.Code != 500 {
+		t.Errorf("Expected 500 for an unknown break column but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSwappableHandler(t *testing.T) {
+	router, err := ConfigureEndpoints(testConfiguration(), testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewSwappableHandler(router)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/renamed?id=4", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected 404 before the swap but got %d", w.Code)
+	}
+
+	config := testConfiguration()
+	config.Endpoints["renamed"] = config.Endpoints["simple"]
+	router, err = ConfigureEndpoints(config, testDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Swap(router)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/renamed?id=4", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected 200 after the swap but got %d", w.Code)
+	}
+}
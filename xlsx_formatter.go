@@ -0,0 +1,390 @@
+package wysci
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`
+
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`
+
+	// The cell formats are referenced by index from the worksheet, see the
+	// xlsxStyle constants.
+	xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy\-mm\-dd"/><numFmt numFmtId="165" formatCode="yyyy\-mm\-dd hh:mm:ss"/></numFmts>` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="5">` +
+		`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+		`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="21" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`</cellXfs>` +
+		`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+		`</styleSheet>`
+
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/><selection pane="bottomLeft"/></sheetView></sheetViews>` +
+		`<sheetData>`
+
+	xlsxWorkbookStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`
+)
+
+type xlsxStyle int
+
+const (
+	xlsxStyleDefault   xlsxStyle = 0
+	xlsxStyleHeader    xlsxStyle = 1
+	xlsxStyleDate      xlsxStyle = 2
+	xlsxStyleTimestamp xlsxStyle = 3
+	xlsxStyleTime      xlsxStyle = 4
+)
+
+// Excel stores dates as the days since its (adjusted) epoch
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// The layouts a date or time column may have after being scanned into a string
+var xlsxTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"15:04:05.999999999",
+}
+
+// Characters Excel does not allow in a sheet name
+var xlsxSheetNameReplacer = strings.NewReplacer(
+	"[", "_", "]", "_", ":", "_", "*", "_", "?", "_", "/", "_", "\\", "_")
+
+// Counts the bytes written to the underlying writer, the zip archive
+// buffers its output so a single row does not map to a single write.
+type countingWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += n
+	return n, err
+}
+
+// XLSXFormatter implements the Formatter interface to write an Excel
+// workbook.  The workbook has a single sheet with a bold, frozen header
+// row and an autofilter over the data.  Rows are streamed into the
+// workbook as they are formatted.  Every call to Format and Finish must
+// be passed the same io.Writer.
+type XLSXFormatter struct {
+	SheetName string
+	query     Query
+	types     []DBType
+	out       *countingWriter
+	archive   *zip.Writer
+	sheet     io.Writer
+	rowCount  int
+}
+
+// NewXLSXFormatter creates a new XLSX Formatter.
+// The sheet name is defaulted to Sheet1.  The query parameter is the
+// executed query whose columns provide the header row and cell types.
+func NewXLSXFormatter(q Query) (*XLSXFormatter, error) {
+	formatter := &XLSXFormatter{}
+	formatter.SheetName = "Sheet1"
+	formatter.query = q
+	formatter.types = q.Types()
+
+	return formatter, nil
+}
+
+// Returns the column letters for a zero based column index
+func xlsxColumn(idx int) string {
+	name := ""
+	for idx >= 0 {
+		name = string(rune('A'+idx%26)) + name
+		idx = idx/26 - 1
+	}
+	return name
+}
+
+// Returns the sheet name with the characters Excel disallows replaced
+func (x *XLSXFormatter) sheetName() string {
+	name := strings.TrimSpace(xlsxSheetNameReplacer.Replace(x.SheetName))
+	if name == "" {
+		return "Sheet1"
+	}
+
+	if len([]rune(name)) > 31 {
+		name = string([]rune(name)[:31])
+	}
+	return name
+}
+
+// Converts a time into an Excel serial date, ignoring the time zone
+func xlsxSerial(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return wall.Sub(xlsxEpoch).Hours() / 24
+}
+
+func parseTimeValue(value string) (time.Time, bool) {
+	for _, layout := range xlsxTimeLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func writeInlineString(b *bytes.Buffer, ref string, style xlsxStyle, value string) {
+	fmt.Fprintf(b, `<c r="%s" t="inlineStr"`, ref)
+	if style != xlsxStyleDefault {
+		fmt.Fprintf(b, ` s="%d"`, style)
+	}
+
+	if strings.TrimSpace(value) != value {
+		b.WriteString(`><is><t xml:space="preserve">`)
+	} else {
+		b.WriteString(`><is><t>`)
+	}
+	xml.EscapeText(b, []byte(value))
+	b.WriteString(`</t></is></c>`)
+}
+
+func writeNumber(b *bytes.Buffer, ref string, style xlsxStyle, value string) {
+	fmt.Fprintf(b, `<c r="%s"`, ref)
+	if style != xlsxStyleDefault {
+		fmt.Fprintf(b, ` s="%d"`, style)
+	}
+	fmt.Fprintf(b, `><v>%s</v></c>`, value)
+}
+
+// Writes a single cell, typed by the column's database type when the
+// value can be represented as that type
+func (x *XLSXFormatter) writeCell(b *bytes.Buffer, col int, value sql.NullString) {
+	ref := fmt.Sprintf("%s%d", xlsxColumn(col), x.rowCount+1)
+	if !value.Valid {
+		return
+	}
+
+	dbType := DBUnknown
+	if col < len(x.types) {
+		dbType = x.types[col]
+	}
+
+	switch dbType {
+	case DBNumber:
+		trimmed := strings.TrimSpace(value.String)
+		f, err := strconv.ParseFloat(trimmed, 64)
+		if err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			writeNumber(b, ref, xlsxStyleDefault, trimmed)
+			return
+		}
+	case DBDate:
+		if t, ok := parseTimeValue(value.String); ok {
+			writeNumber(b, ref, xlsxStyleDate, strconv.FormatFloat(math.Floor(xlsxSerial(t)), 'f', -1, 64))
+			return
+		}
+	case DBTimestamp:
+		if t, ok := parseTimeValue(value.String); ok {
+			writeNumber(b, ref, xlsxStyleTimestamp, strconv.FormatFloat(xlsxSerial(t), 'f', -1, 64))
+			return
+		}
+	case DBTime:
+		if t, ok := parseTimeValue(value.String); ok {
+			serial := xlsxSerial(t)
+			writeNumber(b, ref, xlsxStyleTime, strconv.FormatFloat(serial-math.Floor(serial), 'f', -1, 64))
+			return
+		}
+	case DBBoolean:
+		if parsed, err := strconv.ParseBool(value.String); err == nil {
+			cell := "0"
+			if parsed {
+				cell = "1"
+			}
+			fmt.Fprintf(b, `<c r="%s" t="b"><v>%s</v></c>`, ref, cell)
+			return
+		}
+	}
+
+	writeInlineString(b, ref, xlsxStyleDefault, value.String)
+}
+
+// Opens the archive, writes the fixed parts of the workbook and the
+// header row of the worksheet
+func (x *XLSXFormatter) start(w io.Writer) error {
+	x.out = &countingWriter{w: w}
+	x.archive = zip.NewWriter(x.out)
+
+	parts := []struct {
+		name, content string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+
+	for _, part := range parts {
+		pw, err := x.archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(pw, part.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	sheet, err := x.archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	x.sheet = sheet
+
+	b := new(bytes.Buffer)
+	b.WriteString(xlsxSheetStart)
+	b.WriteString(`<row r="1">`)
+	for i, name := range x.query.columns {
+		writeInlineString(b, fmt.Sprintf("%s1", xlsxColumn(i)), xlsxStyleHeader, name)
+	}
+	b.WriteString(`</row>`)
+	x.rowCount = 1
+
+	_, err = x.sheet.Write(b.Bytes())
+	return err
+}
+
+// Format formats a row as a worksheet row.
+// It implements the Formatter interface for the XLSXFormatter type.
+func (x *XLSXFormatter) Format(values []sql.NullString, w io.Writer) (int, error) {
+	if x.archive == nil {
+		err := x.start(w)
+		if err != nil {
+			log.WithField("message", err.Error()).Errorf("Failed to start workbook: %v", err)
+			return x.out.count, err
+		}
+	}
+	before := x.out.count
+
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, `<row r="%d">`, x.rowCount+1)
+	for i, v := range values {
+		x.writeCell(b, i, v)
+	}
+	b.WriteString(`</row>`)
+	x.rowCount++
+
+	_, err := x.sheet.Write(b.Bytes())
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to write worksheet row: %v", err)
+		return x.out.count - before, err
+	}
+
+	return x.out.count - before, nil
+}
+
+// Finish closes the worksheet, writes the workbook and closes the archive.
+// It implements the Finisher interface for the XLSXFormatter type.
+func (x *XLSXFormatter) Finish(w io.Writer) (int, error) {
+	if x.archive == nil {
+		err := x.start(w)
+		if err != nil {
+			log.WithField("message", err.Error()).Errorf("Failed to start workbook: %v", err)
+			return x.out.count, err
+		}
+	}
+	before := x.out.count
+
+	sheetName := x.sheetName()
+	filterRange := ""
+	if len(x.query.columns) > 0 {
+		filterRange = fmt.Sprintf("$A$1:$%s$%d", xlsxColumn(len(x.query.columns)-1), x.rowCount)
+	}
+
+	b := new(bytes.Buffer)
+	b.WriteString(`</sheetData>`)
+	if filterRange != "" {
+		fmt.Fprintf(b, `<autoFilter ref="%s"/>`, strings.Replace(filterRange, "$", "", -1))
+	}
+	b.WriteString(`</worksheet>`)
+
+	_, err := x.sheet.Write(b.Bytes())
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to close worksheet: %v", err)
+		return x.out.count - before, err
+	}
+
+	b.Reset()
+	b.WriteString(xlsxWorkbookStart)
+	b.WriteString(`<sheets><sheet name="`)
+	xml.EscapeText(b, []byte(sheetName))
+	b.WriteString(`" sheetId="1" r:id="rId1"/></sheets>`)
+	if filterRange != "" {
+		b.WriteString(`<definedNames><definedName name="_xlnm._FilterDatabase" localSheetId="0" hidden="1">`)
+		xml.EscapeText(b, []byte(fmt.Sprintf("'%s'!%s", strings.Replace(sheetName, "'", "''", -1), filterRange)))
+		b.WriteString(`</definedName></definedNames>`)
+	}
+	b.WriteString(`</workbook>`)
+
+	workbook, err := x.archive.Create("xl/workbook.xml")
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to add workbook: %v", err)
+		return x.out.count - before, err
+	}
+
+	_, err = workbook.Write(b.Bytes())
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to write workbook: %v", err)
+		return x.out.count - before, err
+	}
+
+	err = x.archive.Close()
+	if err != nil {
+		log.WithField("message", err.Error()).Errorf("Failed to close workbook archive: %v", err)
+		return x.out.count - before, err
+	}
+
+	return x.out.count - before, nil
+}
+
+// ColumnCount returns the columns in the XLSX formatter.
+// It implements the ColumnCounter interface for the XLSXFormatter type.
+func (x *XLSXFormatter) ColumnCount() int {
+	return len(x.query.columns)
+}
@@ -0,0 +1,131 @@
+package wysci
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func readXLSXPart(t *testing.T, data []byte, name string) string {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	t.Fatalf("Workbook is missing %s", name)
+	return ""
+}
+
+func TestXLSXColumn(t *testing.T) {
+	expected := map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"}
+	for idx, name := range expected {
+		if xlsxColumn(idx) != name {
+			t.Errorf("Expected column %d to be %s but got %s", idx, name, xlsxColumn(idx))
+		}
+	}
+}
+
+func TestXLSXSheetName(t *testing.T) {
+	x := &XLSXFormatter{SheetName: "Sales [2019]: a/b"}
+	if x.sheetName() != "Sales _2019__ a_b" {
+		t.Errorf("Unexpected sheet name %s", x.sheetName())
+	}
+
+	x.SheetName = ""
+	if x.sheetName() != "Sheet1" {
+		t.Errorf("Expected default sheet name but got %s", x.sheetName())
+	}
+}
+
+func TestProcessorWithXLSXFormatter(t *testing.T) {
+	query, err := ExecuteQuery(testConn, "select id, name, some_date from test_simple order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	formatter, err := NewXLSXFormatter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatter.SheetName = "Simple"
+
+	output := new(bytes.Buffer)
+	qp := QueryProcessor{RowFormatter: formatter}
+	byteCount, err := qp.Process(query, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byteCount != output.Len() {
+		t.Errorf("Expected %d bytes but processor reported %d", output.Len(), byteCount)
+	}
+
+	sheet := readXLSXPart(t, output.Bytes(), "xl/worksheets/sheet1.xml")
+	if !strings.Contains(sheet, `<c r="A1" t="inlineStr" s="1"><is><t>id</t></is></c>`) {
+		t.Errorf("Expected a bold header cell: %s", sheet)
+	}
+
+	if !strings.Contains(sheet, `state="frozen"`) {
+		t.Error("Expected the header row to be frozen")
+	}
+
+	if !strings.Contains(sheet, `<autoFilter ref="A1:C6"/>`) {
+		t.Errorf("Expected an autofilter over the data: %s", sheet)
+	}
+
+	if !strings.Contains(sheet, `<c r="A2"><v>1</v></c>`) {
+		t.Errorf("Expected a numeric id cell: %s", sheet)
+	}
+
+	if !strings.Contains(sheet, `<c r="C2" s="2"><v>43466</v></c>`) {
+		t.Errorf("Expected a date cell: %s", sheet)
+	}
+
+	if !strings.Contains(sheet, `embedded,comma`) {
+		t.Error("Expected the data rows in the sheet")
+	}
+
+	workbook := readXLSXPart(t, output.Bytes(), "xl/workbook.xml")
+	if !strings.Contains(workbook, `<sheet name="Simple"`) {
+		t.Errorf("Expected the sheet to be named: %s", workbook)
+	}
+
+	readXLSXPart(t, output.Bytes(), "[Content_Types].xml")
+	readXLSXPart(t, output.Bytes(), "xl/styles.xml")
+}
+
+func TestXLSXFormatterNoRows(t *testing.T) {
+	x := &XLSXFormatter{query: Query{columns: []string{"foo"}}}
+
+	output := new(bytes.Buffer)
+	_, err := x.Finish(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := readXLSXPart(t, output.Bytes(), "xl/worksheets/sheet1.xml")
+	if !strings.Contains(sheet, `<autoFilter ref="A1:A1"/>`) {
+		t.Errorf("Expected an autofilter over the header: %s", sheet)
+	}
+}